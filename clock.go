@@ -0,0 +1,45 @@
+package events
+
+import (
+	"time"
+)
+
+// Clock
+// The source of time for bolts that need to reason about it (expiration,
+// windows, flushing...). It can be replaced to drive time deterministically.
+type Clock interface {
+	Now() time.Time
+	NewTicker(time.Duration) Ticker
+}
+
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// Bolts implementing this receive the pipeline clock before being initialized
+type ClockAware interface {
+	SetClock(Clock)
+}
+
+type systemClock struct{}
+
+func (c systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c systemClock) NewTicker(d time.Duration) Ticker {
+	return &systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t *systemTicker) Chan() <-chan time.Time {
+	return t.C
+}
+
+var (
+	SystemClock Clock = systemClock{}
+)
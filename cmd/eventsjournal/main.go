@@ -0,0 +1,297 @@
+// Command eventsjournal inspects and repairs the journal of a Persister, which
+// must not be running while the journal is modified.
+//
+//	eventsjournal [-keys file] <command> <journal directory>
+//
+// The commands are:
+//
+//	dump      print every record as a line of JSON
+//	stats     print the number of records, keys, time range, commit position
+//	          and corrupted ranges
+//	verify    check the checksums, and the authentication of encrypted records,
+//	          exiting with 1 on errors
+//	truncate  cut every segment after its last valid record
+//	compact   rewrite the journal with only the events not committed
+//
+// Encrypted journals need the keys they are encrypted with, and compacting one
+// encrypts it with the last key given. The keys are read from the file, or from
+// the EVENTSJOURNAL_KEYS environment variable, never from the arguments, which
+// other users can see. They are given as id:hexkey, separated by spaces, commas
+// or new lines.
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	events "github.com/getlantern/events-pipeline"
+	"github.com/getlantern/events-pipeline/journal"
+	"github.com/getlantern/events-pipeline/processors"
+)
+
+const usage = `Usage: eventsjournal [-keys file] <command> <journal directory>
+
+Commands:
+  dump      print every record as a line of JSON
+  stats     print the number of records, keys, time range, commit position
+            and corrupted ranges
+  verify    check the checksums, and the authentication of encrypted records,
+            exiting with 1 on errors
+  truncate  cut every segment after its last valid record
+  compact   rewrite the journal with only the events not committed
+
+Options:
+  -keys file  the keys of an encrypted journal, as id:hexkey, the last one being
+              the current. Defaults to the EVENTSJOURNAL_KEYS environment
+              variable.
+`
+
+// The keys of encrypted journals, nil if none were given
+var journalKeys journal.KeyProvider
+
+// parseKeys parses the keys given as id:hexkey, the last one being the current
+func parseKeys(s string) (journal.KeyProvider, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	})
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	keys := &journal.StaticKeys{Keys: make(map[string][]byte)}
+	for _, f := range fields {
+		parts := strings.SplitN(f, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Keys must be given as id:hexkey")
+		}
+		key, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		keys.Keys[parts[0]] = key
+		keys.Current = parts[0]
+	}
+	return keys, nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	keysFile := flag.String("keys", "", "")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	keys := os.Getenv("EVENTSJOURNAL_KEYS")
+	if *keysFile != "" {
+		b, err := ioutil.ReadFile(*keysFile)
+		if err != nil {
+			fail(err)
+		}
+		keys = string(b)
+	}
+	var err error
+	if journalKeys, err = parseKeys(keys); err != nil {
+		fail(err)
+	}
+	dir := flag.Arg(1)
+	if _, err := os.Stat(dir); err != nil {
+		fail(err)
+	}
+
+	switch flag.Arg(0) {
+	case "dump":
+		dump(dir)
+	case "stats":
+		stats(dir)
+	case "verify":
+		verify(dir)
+	case "truncate":
+		corrupted, err := journal.Truncate(dir, journalKeys)
+		if err != nil {
+			fail(err)
+		}
+		for _, ce := range corrupted {
+			fmt.Printf("Truncated segment %d at offset %d, %d bytes removed\n", ce.Segment, ce.Offset, ce.Size)
+		}
+	case "compact":
+		kept, err := processors.CompactJournal(dir, journalKeys)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("Kept %d records\n", kept)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "eventsjournal: %v\n", err)
+	os.Exit(1)
+}
+
+type dumpedRecord struct {
+	Segment   uint64      `json:"segment"`
+	Offset    int64       `json:"offset"`
+	Index     int         `json:"index,omitempty"`
+	Type      string      `json:"type"`
+	Seq       uint64      `json:"seq,omitempty"`
+	Key       events.Key  `json:"key,omitempty"`
+	Timestamp *time.Time  `json:"timestamp,omitempty"`
+	Vals      events.Vals `json:"vals,omitempty"`
+	// When the event was journaled
+	PersistedAt *time.Time `json:"persisted_at,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+func dump(dir string) {
+	enc := json.NewEncoder(os.Stdout)
+	print := func(d *dumpedRecord) {
+		if err := enc.Encode(d); err != nil {
+			// Values that JSON can't represent
+			enc.Encode(&dumpedRecord{Segment: d.Segment, Offset: d.Offset, Index: d.Index, Type: d.Type, Seq: d.Seq, Key: d.Key, Error: err.Error()})
+		}
+	}
+
+	corrupted, err := journal.ScanDir(dir, journalKeys, func(pos journal.Position, rec []byte) error {
+		d := &dumpedRecord{Segment: pos.Segment, Offset: pos.Offset, Index: pos.Index}
+		r, err := processors.DecodeJournalRecord(rec)
+		if err != nil {
+			d.Type = "undecodable"
+			d.Error = err.Error()
+		} else {
+			d.Type = r.Type.String()
+			d.Seq = r.Seq
+			if r.Event != nil {
+				d.Key = r.Event.Key
+				d.Timestamp = &r.Event.Timestamp
+				d.Vals = r.Event.Vals
+			}
+			if !r.PersistedAt.IsZero() {
+				d.PersistedAt = &r.PersistedAt
+			}
+		}
+		print(d)
+		return nil
+	})
+	if err != nil {
+		fail(err)
+	}
+	for _, ce := range corrupted {
+		print(&dumpedRecord{Segment: ce.Segment, Offset: ce.Offset, Type: "corrupted", Size: ce.Size, Error: ce.Reason})
+	}
+}
+
+func stats(dir string) {
+	var (
+		segments    = make(map[uint64]bool)
+		numEvents   int
+		numCommits  int
+		numReplays  int
+		undecodable int
+		keys        = make(map[events.Key]int)
+		first, last time.Time
+		lastSeq     uint64
+		committed   uint64
+		seqs        []uint64
+	)
+	corrupted, err := journal.ScanDir(dir, journalKeys, func(pos journal.Position, rec []byte) error {
+		segments[pos.Segment] = true
+		r, err := processors.DecodeJournalRecord(rec)
+		if err != nil {
+			undecodable++
+			return nil
+		}
+		switch r.Type {
+		case processors.JournalEvent:
+			numEvents++
+			seqs = append(seqs, r.Seq)
+			if r.Event != nil {
+				keys[r.Event.Key]++
+				ts := r.Event.Timestamp
+				if first.IsZero() || ts.Before(first) {
+					first = ts
+				}
+				if ts.After(last) {
+					last = ts
+				}
+			}
+		case processors.JournalCommit:
+			numCommits++
+			committed = r.Seq
+		case processors.JournalReplay:
+			numReplays++
+		}
+		if r.Seq > lastSeq {
+			lastSeq = r.Seq
+		}
+		return nil
+	})
+	if err != nil {
+		fail(err)
+	}
+
+	uncommitted := 0
+	for _, seq := range seqs {
+		if seq > committed {
+			uncommitted++
+		}
+	}
+
+	fmt.Printf("Segments:     %d\n", len(segments))
+	fmt.Printf("Records:      %d (%d events, %d commits, %d replays, %d undecodable)\n",
+		numEvents+numCommits+numReplays+undecodable, numEvents, numCommits, numReplays, undecodable)
+	if numEvents > 0 {
+		fmt.Printf("Time range:   %v - %v\n", first.Format(time.RFC3339Nano), last.Format(time.RFC3339Nano))
+	}
+	fmt.Printf("Last seq:     %d\n", lastSeq)
+	fmt.Printf("Committed:    up to %d (%d events not committed)\n", committed, uncommitted)
+
+	byCount := make([]events.Key, 0, len(keys))
+	for k := range keys {
+		byCount = append(byCount, k)
+	}
+	sort.Slice(byCount, func(i, j int) bool {
+		if keys[byCount[i]] != keys[byCount[j]] {
+			return keys[byCount[i]] > keys[byCount[j]]
+		}
+		return byCount[i] < byCount[j]
+	})
+	fmt.Printf("Keys:         %d\n", len(keys))
+	for _, k := range byCount {
+		fmt.Printf("  %-40s %d\n", k, keys[k])
+	}
+
+	fmt.Printf("Corrupted:    %d ranges\n", len(corrupted))
+	for _, ce := range corrupted {
+		fmt.Printf("  segment %d, offset %d, %d bytes: %v\n", ce.Segment, ce.Offset, ce.Size, ce.Reason)
+	}
+}
+
+func verify(dir string) {
+	records := 0
+	corrupted, err := journal.ScanDir(dir, journalKeys, func(journal.Position, []byte) error {
+		records++
+		return nil
+	})
+	if err != nil {
+		fail(err)
+	}
+	for _, ce := range corrupted {
+		fmt.Println(ce)
+	}
+	if len(corrupted) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%d records OK\n", records)
+}
@@ -19,10 +19,17 @@ type Event struct {
 	Key       Key
 	Timestamp time.Time
 	Vals      Vals
+	// Set on the events sent again after a restart
+	Replay *Replay
 
 	// Internal
-	wire   *Wire
-	sender Sender
+	wire        *Wire
+	sender      Sender
+	origin      *Event
+	deliveryErr error
+	latency     time.Duration
+	// In the queue of a durable wire
+	seq uint64
 }
 
 func NewEvent(k Key, vals *Vals) *Event {
@@ -33,6 +40,38 @@ func NewEvent(k Key, vals *Vals) *Event {
 	}
 }
 
+// DeliveryError is the error the receiver of the event returned, for the error
+// feedback handlers to see
+func (e *Event) DeliveryError() error {
+	return e.deliveryErr
+}
+
+// DeliveryLatency is how long the receiver of the event took to process it
+func (e *Event) DeliveryLatency() time.Duration {
+	return e.latency
+}
+
+// Origin is the event given to Send, of which the event delivered is a copy.
+// It lets senders recognize their events in the feedback.
+func (e *Event) Origin() *Event {
+	return e.origin
+}
+
+// Replay describes an event sent again after a restart, for the receivers to tell
+// it from the live ones, i.e. to deduplicate it or tag it as late
+type Replay struct {
+	// When the event was first persisted
+	PersistedAt time.Time
+	// Times the event has been sent again, 1 the first time. Replays cut short
+	// by a stop count too.
+	Count int
+	// Where the event is in the journal: the segment, the offset of its frame
+	// in it, and its index in the frame
+	Segment uint64
+	Offset  int64
+	Index   int
+}
+
 type SysEvent string
 
 // System Events
@@ -41,6 +80,8 @@ const (
 	SystemEventInit SysEvent = "init"
 	SystemEventStop SysEvent = "stop"
 	SystemEventMark SysEvent = "mark"
+	// Sent downstream by bolts whose state changes, i.e. running out of disk
+	SystemEventStatus SysEvent = "status"
 )
 
 // Bolt
@@ -53,6 +94,21 @@ type Wire struct {
 	senders   []Sender
 	receivers []Receiver
 	events    *chan *Event
+	// Set on durable wires
+	queue *durableQueue
+}
+
+// Len is the number of events queued in the wire
+func (w *Wire) Len() int {
+	return len(*w.events)
+}
+
+func (w *Wire) Cap() int {
+	return cap(*w.events)
+}
+
+func (w *Wire) NumReceivers() int {
+	return len(w.receivers)
 }
 
 // Sender
@@ -67,6 +123,7 @@ type FeedbackFunc func(e *Event) error
 type SenderBase struct {
 	outlets         []*Wire
 	feedbackHandler FeedbackFunc
+	errorHandler    FeedbackFunc
 }
 
 func (s *SenderBase) ID() string {
@@ -77,14 +134,36 @@ func (s *SenderBase) LinkOutlet(wire *Wire) {
 	s.outlets = append(s.outlets, wire)
 }
 
+// SetErrorFeedback sets the function called after the deliveries that failed,
+// which the feedback handler only gets when they succeed. It must be set before
+// the pipeline runs.
+func (s *SenderBase) SetErrorFeedback(fn FeedbackFunc) {
+	s.errorHandler = fn
+}
+
+func (s *SenderBase) Outlets() []*Wire {
+	return s.outlets
+}
+
+// Send queues the event in every outlet. An event that can't be journaled by a
+// durable wire is still queued, but the error is returned.
 func (s *SenderBase) Send(evt *Event) error {
+	var err error
 	for _, w := range s.outlets {
 		copy := *evt
 		copy.wire = w
 		copy.sender = s
+		copy.origin = evt
+		// Of an upstream durable wire
+		copy.seq = 0
+		if w.queue != nil {
+			if qerr := w.queue.push(&copy); qerr != nil {
+				err = fmt.Errorf("Error journaling event in durable wire: %v", qerr)
+			}
+		}
 		*w.events <- &copy
 	}
-	return nil
+	return err
 }
 
 // Receiver
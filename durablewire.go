@@ -0,0 +1,383 @@
+// Durable wires
+// A durable wire journals the events sent through it before queueing them, and
+// records which ones all the receivers took without errors, with commit records
+// for the sequence number up to which every event was taken, and ack records
+// for the ones taken after an event still missing. The events left, whether they
+// were still queued or failed to be delivered, are queued again the next time
+// the wire is plugged and the pipeline runs, so the events in the wire survive a
+// crash. Events that fail to be delivered are queued again every RetryInterval,
+// and given up on, dead-lettered and taken out of the queue, once they have been
+// failing for DeliveryDeadline.
+// The records have the same layout as those of the processors.Persister.
+// Events without a Key, which only signal the bolts, aren't journaled.
+
+package events
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getlantern/events-pipeline/journal"
+)
+
+type queueRecordType uint8
+
+const (
+	queueEvent  queueRecordType = 1
+	queueCommit queueRecordType = 2
+	queueReplay queueRecordType = 3
+	queueAck    queueRecordType = 4
+)
+
+type queueRecord struct {
+	Type        queueRecordType
+	Seq         uint64
+	Event       *Event
+	PersistedAt time.Time
+}
+
+type failedEvent struct {
+	evt      *Event
+	failedAt time.Time
+	retryAt  time.Time
+}
+
+type durableQueue struct {
+	options *WireOptions
+	journal *journal.Journal
+	// The pipeline's, once it runs
+	clock  Clock
+	closed bool
+	// Last sequence number in every segment with events
+	segmentSeqs map[uint64]uint64
+
+	seq       uint64
+	acked     uint64
+	ackedSeqs map[uint64]bool
+	committed uint64
+	failed    map[uint64]*failedEvent
+
+	recovered []*Event
+	mtx       sync.Mutex
+}
+
+func openDurableQueue(opts *WireOptions) (*durableQueue, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("Durable wires need a Path")
+	}
+	o := *opts
+	if o.RetryInterval == 0 {
+		o.RetryInterval = time.Second
+	}
+	if o.DeliveryDeadline == 0 {
+		o.DeliveryDeadline = time.Minute
+	}
+
+	q := &durableQueue{
+		options:     &o,
+		clock:       SystemClock,
+		segmentSeqs: make(map[uint64]uint64),
+		ackedSeqs:   make(map[uint64]bool),
+		failed:      make(map[uint64]*failedEvent),
+	}
+	if err := q.recover(o.Path); err != nil {
+		return nil, err
+	}
+	j, err := journal.Open(&journal.Options{Dir: o.Path, Sync: o.Sync})
+	if err != nil {
+		return nil, err
+	}
+	q.journal = j
+
+	if len(q.recovered) > 0 {
+		if _, err := q.append(&queueRecord{Type: queueReplay, Seq: q.recovered[len(q.recovered)-1].seq}); err != nil {
+			log.Errorf("Error writing replay record: %v", err)
+		}
+	}
+	return q, nil
+}
+
+// recover finds the events not delivered in the journal
+func (q *durableQueue) recover(dir string) error {
+	var (
+		lastEvent uint64
+		replays   []uint64
+		acks      = make(map[uint64]bool)
+	)
+	corrupted, err := journal.ScanDir(dir, nil, func(pos journal.Position, rec []byte) error {
+		r := new(queueRecord)
+		if err := gob.NewDecoder(bytes.NewReader(rec)).Decode(r); err != nil {
+			log.Errorf("Error decoding wire journal record at %v, skipping it: %v", pos, err)
+			return nil
+		}
+
+		switch r.Type {
+		case queueEvent:
+			if r.Seq <= lastEvent || r.Event == nil {
+				return nil
+			}
+			lastEvent = r.Seq
+			r.Event.seq = r.Seq
+			r.Event.Replay = &Replay{
+				PersistedAt: r.PersistedAt,
+				Segment:     pos.Segment,
+				Offset:      pos.Offset,
+				Index:       pos.Index,
+			}
+			q.recovered = append(q.recovered, r.Event)
+			q.segmentSeqs[pos.Segment] = r.Seq
+		case queueCommit:
+			i := 0
+			for i < len(q.recovered) && q.recovered[i].seq <= r.Seq {
+				i++
+			}
+			q.recovered = q.recovered[i:]
+			q.committed = r.Seq
+		case queueAck:
+			acks[r.Seq] = true
+		case queueReplay:
+			replays = append(replays, r.Seq)
+		}
+		if r.Seq > q.seq {
+			q.seq = r.Seq
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, ce := range corrupted {
+		log.Errorf("Skipped data of the wire journal that couldn't be read: %v", ce)
+	}
+
+	// Only the events not taken are queued again. The others, and the records
+	// that couldn't be read, have nothing to wait for.
+	left := q.recovered[:0]
+	for _, evt := range q.recovered {
+		if !acks[evt.seq] {
+			left = append(left, evt)
+		}
+	}
+	q.recovered = left
+	next := 0
+	for seq := q.committed + 1; seq <= q.seq; seq++ {
+		if next < len(q.recovered) && q.recovered[next].seq == seq {
+			next++
+		} else {
+			q.ackedSeqs[seq] = true
+		}
+	}
+	q.acked = q.committed
+	for q.ackedSeqs[q.acked+1] {
+		delete(q.ackedSeqs, q.acked+1)
+		q.acked++
+	}
+
+	for _, evt := range q.recovered {
+		evt.Replay.Count = 1
+		for _, upTo := range replays {
+			if upTo >= evt.seq {
+				evt.Replay.Count++
+			}
+		}
+	}
+	return nil
+}
+
+// append must be called with the lock held
+func (q *durableQueue) append(r *queueRecord) (journal.Position, error) {
+	if q.closed {
+		return journal.Position{}, os.ErrClosed
+	}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(r); err != nil {
+		return journal.Position{}, err
+	}
+	return q.journal.Append(b.Bytes())
+}
+
+// setClock sets the clock events are timed with
+func (q *durableQueue) setClock(c Clock) {
+	q.mtx.Lock()
+	q.clock = c
+	q.mtx.Unlock()
+}
+
+// push journals an event about to be queued in the wire
+func (q *durableQueue) push(evt *Event) error {
+	if evt.Key == "" {
+		return nil
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	seq := q.seq + 1
+	pos, err := q.append(&queueRecord{Type: queueEvent, Seq: seq, Event: evt, PersistedAt: q.clock.Now()})
+	if err != nil {
+		return err
+	}
+	q.seq = seq
+	q.segmentSeqs[pos.Segment] = seq
+	evt.seq = seq
+	return nil
+}
+
+// ack takes an event delivered to all the receivers out of the queue, writing
+// a commit record, and releasing the segments no longer needed, or an ack
+// record if some event before it is missing
+func (q *durableQueue) ack(evt *Event) error {
+	if evt.seq == 0 {
+		return nil
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return q.acknowledge(evt.seq)
+}
+
+// acknowledge must be called with the lock held
+func (q *durableQueue) acknowledge(seq uint64) error {
+	if seq <= q.acked || q.ackedSeqs[seq] {
+		return nil
+	}
+	delete(q.failed, seq)
+	if seq != q.acked+1 {
+		if _, err := q.append(&queueRecord{Type: queueAck, Seq: seq}); err != nil {
+			return err
+		}
+		q.ackedSeqs[seq] = true
+		return nil
+	}
+
+	q.acked++
+	for q.ackedSeqs[q.acked+1] {
+		delete(q.ackedSeqs, q.acked+1)
+		q.acked++
+	}
+	if _, err := q.append(&queueRecord{Type: queueCommit, Seq: q.acked}); err != nil {
+		return err
+	}
+	q.committed = q.acked
+	segments := q.journal.Segments()
+	for _, n := range segments[:len(segments)-1] {
+		if q.segmentSeqs[n] > q.committed {
+			break
+		}
+		if err := q.journal.Release(n); err != nil {
+			return err
+		}
+		delete(q.segmentSeqs, n)
+	}
+	return nil
+}
+
+// fail keeps an event some receiver didn't take, to queue it again
+func (q *durableQueue) fail(evt *Event, now time.Time) {
+	if evt.seq == 0 {
+		return
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.closed || evt.seq <= q.acked || q.ackedSeqs[evt.seq] {
+		return
+	}
+	fe, ok := q.failed[evt.seq]
+	if !ok {
+		fe = &failedEvent{evt: evt, failedAt: now}
+		q.failed[evt.seq] = fe
+	}
+	fe.retryAt = now.Add(q.options.RetryInterval)
+}
+
+// replay queues the recovered events in the wire, until the pipeline stops
+func (q *durableQueue) replay(w *Wire, stop chan struct{}) {
+	q.mtx.Lock()
+	recovered := q.recovered
+	q.recovered = nil
+	q.mtx.Unlock()
+
+	for _, evt := range recovered {
+		evt.wire = w
+		select {
+		case *w.events <- evt:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// retry queues again the events that failed to be delivered, and gives up on
+// the ones past the DeliveryDeadline, until the pipeline stops
+func (q *durableQueue) retry(w *Wire, stop chan struct{}) {
+	q.mtx.Lock()
+	ticker := q.clock.NewTicker(q.options.RetryInterval)
+	q.mtx.Unlock()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.Chan():
+		case <-stop:
+			return
+		}
+
+		var (
+			seqs           []uint64
+			retries, given []*Event
+		)
+		q.mtx.Lock()
+		now := q.clock.Now()
+		for seq, fe := range q.failed {
+			if now.Before(fe.retryAt) {
+				continue
+			}
+			if now.Sub(fe.failedAt) >= q.options.DeliveryDeadline {
+				if err := q.acknowledge(seq); err != nil {
+					log.Errorf("Error dequeuing event from durable wire: %v", err)
+				}
+				given = append(given, fe.evt)
+				continue
+			}
+			// Not retried again until it fails again
+			fe.retryAt = now.Add(q.options.DeliveryDeadline)
+			seqs = append(seqs, seq)
+		}
+		// In the order they were sent
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+		for _, seq := range seqs {
+			retries = append(retries, q.failed[seq].evt)
+		}
+		q.mtx.Unlock()
+
+		for _, evt := range given {
+			if q.options.DeadLetter != nil {
+				q.options.DeadLetter(evt)
+			} else {
+				log.Errorf("Gave up delivering event %v in durable wire", evt.Key)
+			}
+		}
+		for _, evt := range retries {
+			select {
+			case *w.events <- evt:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+func (q *durableQueue) close() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.closed = true
+	return q.journal.Close()
+}
@@ -0,0 +1,79 @@
+// Compression of segments
+// A compressed segment holds batches of records instead of single records. Each
+// frame holds a batch, compressed with the codec recorded in the segment header,
+// and once decompressed the batch is a sequence of records, each preceded by its
+// length as an unsigned varint.
+
+package journal
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A Codec compresses the batches of records. Other than the built-in Gzip, codecs
+// must be registered to read the segments compressed with them.
+type Codec interface {
+	// Recorded in the header of the segments, so it must never change. 0 means no
+	// compression.
+	ID() byte
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+var (
+	codecs    = make(map[byte]Codec)
+	codecsMtx sync.RWMutex
+
+	Gzip Codec = gzipCodec{}
+)
+
+func init() {
+	RegisterCodec(Gzip)
+}
+
+// RegisterCodec makes the segments compressed with the codec readable
+func RegisterCodec(c Codec) {
+	codecsMtx.Lock()
+	defer codecsMtx.Unlock()
+
+	if c.ID() == 0 {
+		panic("Journal codecs cannot have the ID 0")
+	}
+	if other, ok := codecs[c.ID()]; ok && other.Name() != c.Name() {
+		panic(fmt.Sprintf("Journal codec ID %d is used by %v already", c.ID(), other.Name()))
+	}
+	codecs[c.ID()] = c
+}
+
+func codecByID(id byte) (Codec, error) {
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown journal codec %d, it must be registered", id)
+	}
+	return c, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() byte {
+	return 1
+}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
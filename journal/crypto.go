@@ -0,0 +1,97 @@
+// Encryption of segments
+// Encrypted segments have a header of version 3, followed by the ID of the key
+// they are encrypted with, as a length byte and the ID. Every frame then holds a
+// record, or a compressed batch, encrypted with AES-GCM: a random nonce and the
+// sealed data. The header, the segment number and the offset of the frame are
+// authenticated with it, so records can't be altered nor moved around, and a
+// record that fails the authentication stops the reading with an
+// *AuthenticationError instead of being skipped like the corrupted ones. So does
+// a frame whose checksum doesn't match, unless it's the last one, which a crash
+// can leave incomplete.
+
+package journal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// A KeyProvider supplies the keys that encrypt the segments. The keys are 16, 24
+// or 32 bytes long, for AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new segments with, and its ID, at
+	// most 255 bytes long. Keys are rotated by changing the current one, which is
+	// used from the next segment on.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the ID, to read the segments encrypted with it
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider with a fixed set of keys
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k *StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k *StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown journal key %q", id)
+	}
+	return key, nil
+}
+
+// A record of an encrypted segment that has been altered
+type AuthenticationError struct {
+	Segment uint64
+	Offset  int64
+}
+
+func (e *AuthenticationError) Error() string {
+	return fmt.Sprintf("Journal segment %d failed authentication at offset %d", e.Segment, e.Offset)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData binds a frame to its place in the journal
+func additionalData(header []byte, segment uint64, offset int64) []byte {
+	ad := make([]byte, len(header)+16)
+	copy(ad, header)
+	binary.BigEndian.PutUint64(ad[len(header):], segment)
+	binary.BigEndian.PutUint64(ad[len(header)+8:], uint64(offset))
+	return ad
+}
+
+func (f *segmentFormat) seal(b []byte, offset int64) ([]byte, error) {
+	nonce := make([]byte, f.aead.NonceSize(), f.aead.NonceSize()+len(b)+f.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return f.aead.Seal(nonce, nonce, b, additionalData(f.header, f.segment, offset)), nil
+}
+
+func (f *segmentFormat) open(b []byte, offset int64) ([]byte, error) {
+	if len(b) < f.aead.NonceSize() {
+		return nil, &AuthenticationError{Segment: f.segment, Offset: offset}
+	}
+	nonce, sealed := b[:f.aead.NonceSize()], b[f.aead.NonceSize():]
+	rec, err := f.aead.Open(nil, nonce, sealed, additionalData(f.header, f.segment, offset))
+	if err != nil {
+		return nil, &AuthenticationError{Segment: f.segment, Offset: offset}
+	}
+	return rec, nil
+}
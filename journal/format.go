@@ -0,0 +1,429 @@
+// Segment file format
+// Every segment starts with a header: the magic bytes "EVJL", the format version
+// and 3 bytes that were reserved in version 1. Version 2 keeps in the first one
+// the ID of the codec compressing the segment, and version 3 is for encrypted
+// segments, see crypto.go. Segments are written with the oldest version that has
+// what they need. Then come the records, each framed as:
+//
+//	length  uint32, big endian, of the payload
+//	crc     uint32, big endian, CRC-32C (Castagnoli) of the payload
+//	payload
+//
+// A crash while writing can leave the last frame incomplete, and a bad disk can
+// damage any of them. Reading stops at the first frame that is incomplete or
+// doesn't match its checksum, as the length of a damaged frame can't be trusted
+// to find where the next one starts, and the rest of the segment is reported
+// with a CorruptionError.
+
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// The latest version of the format
+	Version = 3
+
+	headerSize = 8
+	frameSize  = 8
+
+	// Longer records are taken as a damaged length
+	MaxRecordSize = 64 * 1024 * 1024
+)
+
+var (
+	magic    = []byte("EVJL")
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Data of a segment that couldn't be read
+type CorruptionError struct {
+	Segment uint64
+	Offset  int64
+	// Bytes from the offset to the end of the segment
+	Size   int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("Corrupted journal segment %d from offset %d (%d bytes): %v",
+		e.Segment, e.Offset, e.Size, e.Reason)
+}
+
+// How the records of a segment are written
+type segmentFormat struct {
+	segment uint64
+	codec   Codec
+	keyID   string
+	aead    cipher.AEAD
+	// Including the key ID
+	header []byte
+}
+
+// newSegmentFormat returns the format of a new segment, encrypted with the
+// current key if there are keys
+func newSegmentFormat(n uint64, codec Codec, keys KeyProvider) (*segmentFormat, error) {
+	f := &segmentFormat{segment: n, codec: codec}
+	if keys != nil {
+		id, key, err := keys.CurrentKey()
+		if err != nil {
+			return nil, err
+		}
+		if len(id) > 255 {
+			return nil, fmt.Errorf("Journal key IDs cannot be longer than 255 bytes")
+		}
+		if f.aead, err = newAEAD(key); err != nil {
+			return nil, err
+		}
+		f.keyID = id
+	}
+	f.header = f.encodeHeader()
+	return f, nil
+}
+
+func (f *segmentFormat) encodeHeader() []byte {
+	h := make([]byte, headerSize)
+	copy(h, magic)
+	h[4] = 1
+	if f.codec != nil {
+		h[4] = 2
+		h[5] = f.codec.ID()
+	}
+	if f.aead != nil {
+		h[4] = 3
+		h = append(h, byte(len(f.keyID)))
+		h = append(h, f.keyID...)
+	}
+	return h
+}
+
+// readSegmentFormat reads the header of a segment
+func readSegmentFormat(r io.Reader, n uint64, keys KeyProvider) (*segmentFormat, error) {
+	corrupted := func(reason string) error {
+		return &CorruptionError{Segment: n, Reason: reason}
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, corrupted("incomplete header")
+	}
+	if !bytes.Equal(header[:len(magic)], magic) {
+		return nil, corrupted("not a journal segment")
+	}
+	f := &segmentFormat{segment: n, header: header}
+	switch header[4] {
+	case 1:
+		if !bytes.Equal(header[5:], []byte{0, 0, 0}) {
+			return nil, corrupted("bad header")
+		}
+		return f, nil
+	case 2, 3:
+		if !bytes.Equal(header[6:], []byte{0, 0}) {
+			return nil, corrupted("bad header")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported journal segment version %d", header[4])
+	}
+	if header[5] != 0 {
+		var err error
+		if f.codec, err = codecByID(header[5]); err != nil {
+			return nil, err
+		}
+	}
+	if header[4] == 2 {
+		return f, nil
+	}
+
+	l := make([]byte, 1)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return nil, corrupted("incomplete header")
+	}
+	id := make([]byte, l[0])
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, corrupted("incomplete header")
+	}
+	f.keyID = string(id)
+	f.header = append(append(header, l...), id...)
+	if keys == nil {
+		return nil, fmt.Errorf("Journal segment %d is encrypted, and there are no keys", n)
+	}
+	key, err := keys.Key(f.keyID)
+	if err != nil {
+		return nil, err
+	}
+	if f.aead, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func frame(rec []byte) []byte {
+	buf := make([]byte, frameSize+len(rec))
+	binary.BigEndian.PutUint32(buf, uint32(len(rec)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(rec, crcTable))
+	copy(buf[frameSize:], rec)
+	return buf
+}
+
+// segmentCodec returns the codec of a segment, nil if it isn't compressed
+func segmentCodec(path string) (Codec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(f, header); err != nil || header[4] < 2 || header[5] == 0 {
+		return nil, nil
+	}
+	return codecByID(header[5])
+}
+
+// ScanSegment calls the function with every valid record in a segment file, and
+// returns a *CorruptionError if it ends with data that isn't one. The keys are
+// needed for encrypted segments, and reading stops with an *AuthenticationError
+// at a record that has been altered.
+func ScanSegment(path string, n uint64, keys KeyProvider, fn func(Position, []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return scanSegment(bufio.NewReader(f), info.Size(), n, keys, fn)
+}
+
+func scanSegment(r io.Reader, size int64, n uint64, keys KeyProvider, fn func(Position, []byte) error) error {
+	corrupted := func(offset int64, reason string) error {
+		return &CorruptionError{Segment: n, Offset: offset, Size: size - offset, Reason: reason}
+	}
+
+	// An empty segment is one created right before a crash
+	if size == 0 {
+		return nil
+	}
+	format, err := readSegmentFormat(r, n, keys)
+	if ce, ok := err.(*CorruptionError); ok {
+		return corrupted(0, ce.Reason)
+	} else if err != nil {
+		return err
+	}
+
+	offset := int64(len(format.header))
+	var fh [frameSize]byte
+	for {
+		if _, err := io.ReadFull(r, fh[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return corrupted(offset, "incomplete frame header")
+		}
+		// In encrypted segments only what a crash leaves at the end is taken as
+		// corruption, and anything else as an altered record
+		length := binary.BigEndian.Uint32(fh[:])
+		if length > MaxRecordSize && format.aead != nil {
+			return &AuthenticationError{Segment: n, Offset: offset}
+		}
+		if length > MaxRecordSize || int64(length) > size-offset-frameSize {
+			return corrupted(offset, "incomplete record")
+		}
+		rec := make([]byte, length)
+		if _, err := io.ReadFull(r, rec); err != nil {
+			return corrupted(offset, "incomplete record")
+		}
+		if crc32.Checksum(rec, crcTable) != binary.BigEndian.Uint32(fh[4:]) {
+			if format.aead != nil && offset+frameSize+int64(length) < size {
+				return &AuthenticationError{Segment: n, Offset: offset}
+			}
+			return corrupted(offset, "checksum mismatch")
+		}
+		if format.aead != nil {
+			if rec, err = format.open(rec, offset); err != nil {
+				return err
+			}
+		}
+
+		pos := Position{Segment: n, Offset: offset}
+		if format.codec == nil {
+			if err := fn(pos, rec); err != nil {
+				return err
+			}
+		} else {
+			batch, err := decodeBatch(format.codec, rec)
+			if err != nil {
+				return corrupted(offset, err.Error())
+			}
+			for i, rec := range batch {
+				pos.Index = i
+				if err := fn(pos, rec); err != nil {
+					return err
+				}
+			}
+		}
+		offset += frameSize + int64(length)
+	}
+}
+
+// decodeBatch returns the records of a compressed batch
+func decodeBatch(codec Codec, b []byte) ([][]byte, error) {
+	r, err := codec.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("undecodable batch: %v", err)
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(r, MaxRecordSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("undecodable batch: %v", err)
+	}
+	if len(raw) > MaxRecordSize {
+		return nil, fmt.Errorf("batch too large")
+	}
+
+	var batch [][]byte
+	for len(raw) > 0 {
+		length, n := binary.Uvarint(raw)
+		if n <= 0 || length > uint64(len(raw)-n) {
+			return nil, fmt.Errorf("bad batch")
+		}
+		batch = append(batch, raw[n:n+int(length)])
+		raw = raw[n+int(length):]
+	}
+	return batch, nil
+}
+
+// segmentWriter writes the records of a segment, gathering them in batches of
+// at most maxBatch records if the segment is compressed
+type segmentWriter struct {
+	w      io.Writer
+	format *segmentFormat
+	// Bytes written so far
+	size int64
+	// A frame was cut short and couldn't be taken back, so nothing can be
+	// written after it
+	torn bool
+
+	batch        []byte
+	batchRecords int
+	maxBatch     int
+}
+
+func newSegmentWriter(w io.Writer, format *segmentFormat, maxBatch int) (*segmentWriter, error) {
+	n, err := w.Write(format.header)
+	return &segmentWriter{w: w, format: format, size: int64(n), maxBatch: maxBatch}, err
+}
+
+// empty tells whether no record has been added
+func (sw *segmentWriter) empty() bool {
+	return sw.size <= int64(len(sw.format.header)) && sw.batchRecords == 0
+}
+
+// add writes a record, or adds it to the batch, and returns where it is
+func (sw *segmentWriter) add(rec []byte) (offset int64, index int, err error) {
+	if sw.format.codec == nil {
+		offset = sw.size
+		return offset, 0, sw.writeFrame(rec)
+	}
+
+	// The record isn't added if the batch can't be written
+	if sw.batchRecords >= sw.maxBatch || len(sw.batch)+binary.MaxVarintLen64+len(rec) > MaxRecordSize {
+		if err := sw.flush(); err != nil {
+			return sw.size, 0, err
+		}
+	}
+	var l [binary.MaxVarintLen64]byte
+	sw.batch = append(sw.batch, l[:binary.PutUvarint(l[:], uint64(len(rec)))]...)
+	sw.batch = append(sw.batch, rec...)
+	sw.batchRecords++
+	return sw.size, sw.batchRecords - 1, nil
+}
+
+// pending returns the size of the batch waiting to be written, uncompressed
+func (sw *segmentWriter) pending() int64 {
+	return int64(len(sw.batch))
+}
+
+// flush compresses and writes the batch. The batch is kept if it fails, to be
+// written with the next flush.
+func (sw *segmentWriter) flush() error {
+	if sw.batchRecords == 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	cw, err := sw.format.codec.NewWriter(&b)
+	if err != nil {
+		return err
+	}
+	_, err = cw.Write(sw.batch)
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = sw.writeFrame(b.Bytes())
+	}
+	if err != nil {
+		return err
+	}
+	sw.batch, sw.batchRecords = sw.batch[:0], 0
+	return nil
+}
+
+// takeBatch returns the batch not written, to be written in another segment
+func (sw *segmentWriter) takeBatch() ([]byte, int) {
+	batch, records := sw.batch, sw.batchRecords
+	sw.batch, sw.batchRecords = nil, 0
+	return batch, records
+}
+
+func (sw *segmentWriter) writeFrame(payload []byte) error {
+	if sw.torn {
+		return fmt.Errorf("Journal segment %d has a torn frame", sw.format.segment)
+	}
+	if sw.format.aead != nil {
+		var err error
+		if payload, err = sw.format.seal(payload, sw.size); err != nil {
+			return err
+		}
+	}
+	if len(payload) > MaxRecordSize {
+		return fmt.Errorf("Journal records cannot be larger than %d bytes", MaxRecordSize)
+	}
+	n, err := sw.w.Write(frame(payload))
+	if err != nil {
+		// Reading stops at a torn frame, so the records after it would be lost
+		if n > 0 && sw.truncate() != nil {
+			sw.torn = true
+		}
+		return err
+	}
+	sw.size += int64(n)
+	return nil
+}
+
+// truncate takes back what was written after the last whole frame
+func (sw *segmentWriter) truncate() error {
+	f, ok := sw.w.(interface {
+		Truncate(size int64) error
+		Seek(offset int64, whence int) (int64, error)
+	})
+	if !ok {
+		return fmt.Errorf("Journal segment %d cannot be truncated", sw.format.segment)
+	}
+	if err := f.Truncate(sw.size); err != nil {
+		return err
+	}
+	_, err := f.Seek(sw.size, io.SeekStart)
+	return err
+}
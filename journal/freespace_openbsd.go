@@ -0,0 +1,15 @@
+package journal
+
+import (
+	"syscall"
+)
+
+// FreeSpace returns the bytes available to the process in the file system of
+// the directory
+func FreeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.F_bavail) * uint64(st.F_bsize), nil
+}
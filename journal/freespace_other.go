@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!openbsd,!dragonfly,!windows
+
+package journal
+
+import (
+	"errors"
+)
+
+// FreeSpace returns the bytes available to the process in the file system of
+// the directory
+func FreeSpace(dir string) (uint64, error) {
+	return 0, errors.New("Free space can't be checked on this system")
+}
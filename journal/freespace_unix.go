@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package journal
+
+import (
+	"syscall"
+)
+
+// FreeSpace returns the bytes available to the process in the file system of
+// the directory
+func FreeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+package journal
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// FreeSpace returns the bytes available to the process in the file system of
+// the directory
+func FreeSpace(dir string) (uint64, error) {
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	r, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&free)), 0, 0)
+	if r == 0 {
+		return 0, err
+	}
+	return free, nil
+}
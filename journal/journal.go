@@ -0,0 +1,541 @@
+// Package journal implements an append-only log of records split in numbered
+// segment files. A new segment is started when the current one reaches its
+// maximum size or age, and every time the journal is opened, so appends never
+// go after a record that may have been left half written. Segments whose
+// records are no longer needed are released, and then deleted or archived
+// according to the retention policy.
+// How often the segments are synced to disk depends on the SyncPolicy. Appends
+// that have to wait for a sync share it with the others waiting (group commit),
+// so concurrent appends cost a single sync.
+// Segments can be compressed, with records gathered in batches that are written
+// when full with the next append, when the journal is synced, and at least every
+// SyncInterval. A batch that fails to be written is kept, and the error returned
+// by the next append or sync. The records still in a batch are lost if the
+// process crashes. When a torn frame ends a segment, its batch is written in the
+// next one instead, and Carried tells where, since the positions returned by
+// Append for those records were in the segment they left.
+package journal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+)
+
+var (
+	log = golog.LoggerFor("journal")
+)
+
+const (
+	segmentExt = ".journal"
+
+	DefaultMaxSegmentSize = 16 * 1024 * 1024
+
+	defaultBatchRecords = 100
+)
+
+type RetentionPolicy int
+
+const (
+	// Delete the released segments
+	DeleteReleased RetentionPolicy = iota
+	// Move the released segments to the archive directory
+	ArchiveReleased
+)
+
+type SyncPolicy int
+
+const (
+	// Leave it to the operating system
+	SyncNever SyncPolicy = iota
+	// Appends return once the record is on disk
+	SyncAlways
+	// Sync every SyncInterval
+	SyncInterval
+	// Sync every SyncEvents records
+	SyncEvery
+)
+
+type Options struct {
+	// Directory of the segments, created if needed
+	Dir string
+	// Defaults to DefaultMaxSegmentSize
+	MaxSegmentSize int64
+	// Zero means that segments are never rotated because of their age
+	MaxSegmentAge time.Duration
+
+	Retention RetentionPolicy
+	// Defaults to the "archive" directory inside Dir
+	ArchiveDir string
+	// Archived segments kept, the oldest being deleted. Zero means no limit.
+	MaxArchived int
+
+	Sync SyncPolicy
+	// Defaults to a second
+	SyncInterval time.Duration
+	// Defaults to 100
+	SyncEvents int
+
+	// Compresses the new segments. Nil means no compression.
+	Codec Codec
+	// Records compressed together at most. Defaults to 100.
+	BatchRecords int
+
+	// Encrypts the new segments with the current key, and decrypts the existing
+	// ones. Nil means no encryption.
+	Keys KeyProvider
+
+	// Defaults to time.Now
+	Now func() time.Time
+}
+
+// Where a record is: its segment, its offset in it and, in compressed segments,
+// its index in the batch at that offset
+type Position struct {
+	Segment uint64
+	Offset  int64
+	Index   int
+}
+
+func (p Position) String() string {
+	if p.Index > 0 {
+		return fmt.Sprintf("%d:%d#%d", p.Segment, p.Offset, p.Index)
+	}
+	return fmt.Sprintf("%d:%d", p.Segment, p.Offset)
+}
+
+type Journal struct {
+	options *Options
+
+	segments []uint64
+	// Of the segments other than the current one
+	sizes map[uint64]int64
+	// Segments whose batch went to the next one after a torn frame
+	carried map[uint64]uint64
+	current *os.File
+	writer  *segmentWriter
+	created time.Time
+	mtx     sync.Mutex
+
+	// Records appended and synced so far, and whether a sync is going on
+	appended uint64
+	synced   uint64
+	syncing  bool
+	syncErr  error
+	syncDone *sync.Cond
+	stop     chan struct{}
+	stopped  sync.WaitGroup
+}
+
+func Open(opts *Options) (*Journal, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("The journal needs a directory")
+	}
+	if opts.MaxSegmentSize == 0 {
+		opts.MaxSegmentSize = DefaultMaxSegmentSize
+	}
+	if opts.ArchiveDir == "" {
+		opts.ArchiveDir = filepath.Join(opts.Dir, "archive")
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.SyncInterval == 0 {
+		opts.SyncInterval = time.Second
+	}
+	if opts.SyncEvents == 0 {
+		opts.SyncEvents = 100
+	}
+	if opts.BatchRecords == 0 {
+		opts.BatchRecords = defaultBatchRecords
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		options:  opts,
+		segments: segments,
+		sizes:    make(map[uint64]int64),
+		carried:  make(map[uint64]uint64),
+	}
+	for _, n := range segments {
+		info, err := os.Stat(j.path(n))
+		if err != nil {
+			return nil, err
+		}
+		j.sizes[n] = info.Size()
+	}
+	j.syncDone = sync.NewCond(&j.mtx)
+	if err := j.rotate(); err != nil {
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval || opts.Codec != nil {
+		j.stop = make(chan struct{})
+		j.stopped.Add(1)
+		go j.syncPeriodically()
+	}
+	return j, nil
+}
+
+func segmentName(n uint64) string {
+	return fmt.Sprintf("%020d%s", n, segmentExt)
+}
+
+// listSegments returns the numbers of the segments in the directory, in order
+func listSegments(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Slice(segments, func(i, k int) bool { return segments[i] < segments[k] })
+	return segments, nil
+}
+
+func (j *Journal) path(n uint64) string {
+	return filepath.Join(j.options.Dir, segmentName(n))
+}
+
+// rotate closes the current segment and starts the next one. It must be called
+// with the lock held.
+func (j *Journal) rotate() error {
+	old := j.writer
+	if j.current != nil {
+		// After a torn frame the batch goes to the next segment
+		if !j.writer.torn {
+			if err := j.writer.flush(); err != nil {
+				// Not closing the segment with records that could be written later
+				return err
+			}
+		}
+		// The records waiting for a sync are in this segment
+		if j.options.Sync != SyncNever && j.synced < j.appended {
+			j.syncErr = j.current.Sync()
+			j.synced = j.appended
+			j.syncDone.Broadcast()
+		}
+		if err := j.current.Close(); err != nil {
+			log.Errorf("Error closing journal segment: %v", err)
+		}
+		j.sizes[j.segments[len(j.segments)-1]] = j.writer.size
+		j.current = nil
+	}
+
+	n := uint64(1)
+	if len(j.segments) > 0 {
+		n = j.segments[len(j.segments)-1] + 1
+	}
+	f, err := os.OpenFile(j.path(n), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	format, err := newSegmentFormat(n, j.options.Codec, j.options.Keys)
+	if err != nil {
+		f.Close()
+		os.Remove(j.path(n))
+		return err
+	}
+	w, err := newSegmentWriter(f, format, j.options.BatchRecords)
+	if err != nil {
+		f.Close()
+		os.Remove(j.path(n))
+		return err
+	}
+	if old != nil && old.torn {
+		w.batch, w.batchRecords = old.takeBatch()
+		if w.batchRecords > 0 {
+			j.carried[j.segments[len(j.segments)-1]] = n
+		}
+	}
+	j.current = f
+	j.writer = w
+	j.created = j.options.Now()
+	j.segments = append(j.segments, n)
+	return nil
+}
+
+// Append writes a record, in a new segment if the current one is due, and
+// returns where it was written
+func (j *Journal) Append(rec []byte) (Position, error) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if j.current == nil {
+		return Position{}, os.ErrClosed
+	}
+	if len(rec) > MaxRecordSize {
+		return Position{}, fmt.Errorf("Journal records cannot be larger than %d bytes", MaxRecordSize)
+	}
+	// Batches are counted uncompressed, so compressed segments end up smaller
+	size := j.writer.size + j.writer.pending()
+	if j.writer.torn || !j.writer.empty() && (size+frameSize+int64(len(rec)) > j.options.MaxSegmentSize ||
+		(j.options.MaxSegmentAge != 0 && j.options.Now().Sub(j.created) >= j.options.MaxSegmentAge)) {
+		if err := j.rotate(); err != nil {
+			return Position{}, err
+		}
+	}
+
+	pos := Position{Segment: j.segments[len(j.segments)-1]}
+	var err error
+	pos.Offset, pos.Index, err = j.writer.add(rec)
+	if err != nil {
+		return pos, err
+	}
+	j.appended++
+
+	switch j.options.Sync {
+	case SyncAlways:
+		err = j.sync(j.appended)
+	case SyncEvery:
+		if j.appended-j.synced >= uint64(j.options.SyncEvents) {
+			err = j.sync(j.appended)
+		}
+	}
+	return pos, err
+}
+
+// sync returns once the records up to the given one are on disk. Only one sync
+// happens at a time, and it covers all the records appended when it starts.
+// It must be called with the lock held, which is released while syncing.
+func (j *Journal) sync(upTo uint64) error {
+	for j.synced < upTo {
+		if j.syncing {
+			j.syncDone.Wait()
+			continue
+		}
+
+		if err := j.writer.flush(); err != nil {
+			return err
+		}
+		j.syncing = true
+		f, target := j.current, j.appended
+		j.mtx.Unlock()
+		err := f.Sync()
+		j.mtx.Lock()
+		j.syncing = false
+		// Rotating the segment meanwhile syncs and closes it
+		if target > j.synced {
+			j.synced = target
+			j.syncErr = err
+		}
+		j.syncDone.Broadcast()
+	}
+	return j.syncErr
+}
+
+// syncPeriodically syncs every SyncInterval, or only writes the batch if the
+// policy isn't SyncInterval
+func (j *Journal) syncPeriodically() {
+	defer j.stopped.Done()
+
+	ticker := time.NewTicker(j.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			j.mtx.Lock()
+			switch {
+			case j.current == nil:
+			case j.options.Sync != SyncInterval:
+				if err := j.writer.flush(); err != nil {
+					log.Errorf("Error writing journal batch: %v", err)
+				}
+			case j.synced < j.appended:
+				if err := j.sync(j.appended); err != nil {
+					log.Errorf("Error syncing journal: %v", err)
+				}
+			}
+			j.mtx.Unlock()
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+// Segments returns the numbers of the segments not released, in order. The last
+// one is where records are being appended.
+func (j *Journal) Segments() []uint64 {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	return append([]uint64(nil), j.segments...)
+}
+
+// Size returns the bytes taken by the segments not released, counting the
+// records in a batch as not compressed
+func (j *Journal) Size() int64 {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	size := int64(0)
+	for _, s := range j.sizes {
+		size += s
+	}
+	if j.writer != nil {
+		size += j.writer.size + j.writer.pending()
+	}
+	return size
+}
+
+// Release tells the journal that the records of a segment are no longer needed.
+// The current segment cannot be released.
+func (j *Journal) Release(n uint64) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if err := j.remove(n); err != nil {
+		return err
+	}
+	if j.options.Retention == DeleteReleased {
+		return os.Remove(j.path(n))
+	}
+	if err := os.MkdirAll(j.options.ArchiveDir, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(j.path(n), filepath.Join(j.options.ArchiveDir, segmentName(n))); err != nil {
+		return err
+	}
+	return j.pruneArchive()
+}
+
+// Evict deletes a segment whose records may still be needed, whatever the
+// retention policy, to make room. The current segment cannot be evicted.
+func (j *Journal) Evict(n uint64) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if err := j.remove(n); err != nil {
+		return err
+	}
+	return os.Remove(j.path(n))
+}
+
+// remove takes a segment out of the journal. It must be called with the lock
+// held.
+func (j *Journal) remove(n uint64) error {
+	i := sort.Search(len(j.segments), func(i int) bool { return j.segments[i] >= n })
+	if i == len(j.segments) || j.segments[i] != n {
+		return fmt.Errorf("Unknown journal segment %d", n)
+	}
+	if i == len(j.segments)-1 && j.current != nil {
+		return fmt.Errorf("The current journal segment cannot be released")
+	}
+	j.segments = append(j.segments[:i], j.segments[i+1:]...)
+	delete(j.sizes, n)
+	delete(j.carried, n)
+	return nil
+}
+
+// Carried tells the segment the batch of segment n was written in, when a torn
+// frame ended n before it could be
+func (j *Journal) Carried(n uint64) (uint64, bool) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	to, ok := j.carried[n]
+	return to, ok
+}
+
+func (j *Journal) pruneArchive() error {
+	if j.options.MaxArchived == 0 {
+		return nil
+	}
+	archived, err := listSegments(j.options.ArchiveDir)
+	if err != nil {
+		return err
+	}
+	for len(archived) > j.options.MaxArchived {
+		if err := os.Remove(filepath.Join(j.options.ArchiveDir, segmentName(archived[0]))); err != nil {
+			return err
+		}
+		archived = archived[1:]
+	}
+	return nil
+}
+
+// Scan calls the function with every valid record in the segments not released,
+// in order, until it returns an error. The data that couldn't be read is skipped
+// and returned. The records still in a batch aren't scanned.
+func (j *Journal) Scan(fn func(Position, []byte) error) ([]*CorruptionError, error) {
+	return scanSegments(j.options.Dir, j.Segments(), j.options.Keys, fn)
+}
+
+// ScanDir is like Scan, for the journal in a directory that isn't open. The keys
+// are needed if it has encrypted segments.
+func ScanDir(dir string, keys KeyProvider, fn func(Position, []byte) error) ([]*CorruptionError, error) {
+	segments, err := listSegments(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return scanSegments(dir, segments, keys, fn)
+}
+
+func scanSegments(dir string, segments []uint64, keys KeyProvider, fn func(Position, []byte) error) ([]*CorruptionError, error) {
+	var corrupted []*CorruptionError
+	for _, n := range segments {
+		err := ScanSegment(filepath.Join(dir, segmentName(n)), n, keys, fn)
+		if ce, ok := err.(*CorruptionError); ok {
+			corrupted = append(corrupted, ce)
+		} else if err != nil {
+			return corrupted, err
+		}
+	}
+	return corrupted, nil
+}
+
+func (j *Journal) Close() error {
+	if j.stop != nil {
+		close(j.stop)
+		j.stopped.Wait()
+		j.stop = nil
+	}
+
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if j.current == nil {
+		return nil
+	}
+	// Wait for any sync going on, which uses the file
+	for j.syncing {
+		j.syncDone.Wait()
+	}
+	err := j.writer.flush()
+	if err == nil && j.options.Sync != SyncNever && j.synced < j.appended {
+		err = j.current.Sync()
+		j.synced = j.appended
+	}
+	if cerr := j.current.Close(); err == nil {
+		err = cerr
+	}
+	j.current = nil
+	j.writer = nil
+	return err
+}
@@ -0,0 +1,609 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func records(n int) [][]byte {
+	var recs [][]byte
+	for i := 0; i < n; i++ {
+		recs = append(recs, []byte(fmt.Sprintf("The record number %d", i)))
+	}
+	return recs
+}
+
+func scanAll(t *testing.T, dir string) ([][]byte, []*CorruptionError) {
+	var recs [][]byte
+	corrupted, err := ScanDir(dir, nil, func(pos Position, rec []byte) error {
+		recs = append(recs, rec)
+		return nil
+	})
+	assert.Nil(t, err, "Should be nil")
+	return recs, corrupted
+}
+
+func TestJournal(t *testing.T) {
+	dir := "test-journal"
+	defer os.RemoveAll(dir)
+
+	j, err := Open(&Options{Dir: dir, MaxSegmentSize: 100})
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	recs := records(10)
+	for _, rec := range recs {
+		_, err := j.Append(rec)
+		assert.Nil(t, err, "Should be nil")
+	}
+
+	segments := j.Segments()
+	assert.Equal(t, 4, len(segments), "Records should have been split in segments")
+	assert.NotNil(t, j.Release(segments[len(segments)-1]), "The current segment can't be released")
+	assert.Nil(t, j.Release(segments[0]), "Should be nil")
+	assert.Nil(t, j.Close(), "Should be nil")
+
+	read, corrupted := scanAll(t, dir)
+	assert.Equal(t, recs[3:], read, "The records of the released segment should be gone")
+	assert.Empty(t, corrupted, "Nothing should be corrupted")
+
+	// Reopening starts a new segment
+	j, err = Open(&Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	pos, err := j.Append([]byte("Last"))
+	assert.Nil(t, err, "Should be nil")
+	assert.Equal(t, Position{Segment: 5, Offset: headerSize}, pos, "Should be at the start of a new segment")
+	assert.Nil(t, j.Close(), "Should be nil")
+}
+
+func TestJournalTornWrite(t *testing.T) {
+	dir := "test-journal-torn"
+	defer os.RemoveAll(dir)
+
+	j, err := Open(&Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	recs := records(3)
+	for _, rec := range recs {
+		_, err := j.Append(rec)
+		assert.Nil(t, err, "Should be nil")
+	}
+	assert.Nil(t, j.Close(), "Should be nil")
+
+	// Cut the last record in half
+	path := filepath.Join(dir, segmentName(1))
+	info, err := os.Stat(path)
+	assert.Nil(t, err, "Should be nil")
+	assert.Nil(t, os.Truncate(path, info.Size()-5), "Should be nil")
+
+	read, corrupted := scanAll(t, dir)
+	assert.Equal(t, recs[:2], read, "The complete records should be read")
+	if assert.Equal(t, 1, len(corrupted), "The torn record should be reported") {
+		assert.Equal(t, uint64(1), corrupted[0].Segment, "Should hold this value")
+		assert.Equal(t, int64(frameSize+len(recs[2])-5), corrupted[0].Size, "Should hold this value")
+	}
+}
+
+// Writes half of what it's given and fails while failing is set
+type failingFile struct {
+	*os.File
+	failing bool
+}
+
+func (f *failingFile) Write(b []byte) (int, error) {
+	if !f.failing {
+		return f.File.Write(b)
+	}
+	n, _ := f.File.Write(b[:len(b)/2])
+	return n, fmt.Errorf("Disk full")
+}
+
+func TestJournalWriteErrors(t *testing.T) {
+	dir := "test-journal-write-errors"
+	defer os.RemoveAll(dir)
+
+	j, err := Open(&Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	recs := records(4)
+	failing := &failingFile{File: j.current}
+	j.writer.w = failing
+
+	_, err = j.Append(recs[0])
+	assert.Nil(t, err, "Should be nil")
+	failing.failing = true
+	_, err = j.Append(recs[1])
+	assert.NotNil(t, err, "The write should fail")
+	failing.failing = false
+	_, err = j.Append(recs[2])
+	assert.Nil(t, err, "The torn frame should have been taken back")
+
+	// A torn frame that can't be taken back ends the segment
+	j.writer.w = struct{ io.Writer }{failing}
+	failing.failing = true
+	_, err = j.Append(recs[3])
+	assert.NotNil(t, err, "The write should fail")
+	failing.failing = false
+	pos, err := j.Append(recs[3])
+	assert.Nil(t, err, "Should be nil")
+	assert.Equal(t, uint64(2), pos.Segment, "Should be in a new segment")
+	assert.Nil(t, j.Close(), "Should be nil")
+
+	read, corrupted := scanAll(t, dir)
+	assert.Equal(t, [][]byte{recs[0], recs[2], recs[3]}, read, "The records appended should be read")
+	if assert.Equal(t, 1, len(corrupted), "The torn frame should be reported") {
+		assert.Equal(t, uint64(1), corrupted[0].Segment, "Should hold this value")
+	}
+
+	// A batch that can't be written is kept, and the record that didn't fit isn't
+	// added
+	os.RemoveAll(dir)
+	j, err = Open(&Options{Dir: dir, Codec: Gzip, BatchRecords: 2})
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	failing = &failingFile{File: j.current}
+	j.writer.w = failing
+	for _, rec := range recs[:2] {
+		_, err = j.Append(rec)
+		assert.Nil(t, err, "Should be nil")
+	}
+	failing.failing = true
+	_, err = j.Append(recs[2])
+	assert.NotNil(t, err, "The batch should fail to be written")
+	failing.failing = false
+	_, err = j.Append(recs[3])
+	assert.Nil(t, err, "Should be nil")
+	assert.Nil(t, j.Close(), "Should be nil")
+
+	read, corrupted = scanAll(t, dir)
+	assert.Equal(t, [][]byte{recs[0], recs[1], recs[3]}, read, "The records appended should be read")
+	assert.Empty(t, corrupted, "Nothing should be corrupted")
+
+	// A batch a torn frame kept from being written goes to the next segment
+	os.RemoveAll(dir)
+	j, err = Open(&Options{Dir: dir, Codec: Gzip, BatchRecords: 2})
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	failing = &failingFile{File: j.current}
+	j.writer.w = struct{ io.Writer }{failing}
+	for _, rec := range recs[:2] {
+		pos, err = j.Append(rec)
+		assert.Nil(t, err, "Should be nil")
+		assert.Equal(t, uint64(1), pos.Segment, "Should be in the first segment")
+	}
+	failing.failing = true
+	_, err = j.Append(recs[2])
+	assert.NotNil(t, err, "The batch should fail to be written")
+	failing.failing = false
+	_, ok := j.Carried(1)
+	assert.False(t, ok, "The segment should not be ended yet")
+	_, err = j.Append(recs[2])
+	assert.Nil(t, err, "Should be nil")
+	to, ok := j.Carried(1)
+	assert.True(t, ok, "The batch should have been carried")
+	assert.Equal(t, uint64(2), to, "Should be in the new segment")
+	assert.Nil(t, j.Release(1), "Should be nil")
+	_, ok = j.Carried(1)
+	assert.False(t, ok, "Should be forgotten once released")
+	assert.Nil(t, j.Close(), "Should be nil")
+
+	read, corrupted = scanAll(t, dir)
+	assert.Equal(t, [][]byte{recs[0], recs[1], recs[2]}, read, "The records appended should be read")
+	assert.Empty(t, corrupted, "The released segment should not be scanned")
+}
+
+func segmentBytes(recs [][]byte, codec Codec, keys KeyProvider) []byte {
+	var b bytes.Buffer
+	format, _ := newSegmentFormat(1, codec, keys)
+	w, _ := newSegmentWriter(&b, format, defaultBatchRecords)
+	for i, rec := range recs {
+		w.add(rec)
+		if i%3 == 2 {
+			w.flush()
+		}
+	}
+	w.flush()
+	return b.Bytes()
+}
+
+func scanBytes(b []byte, keys KeyProvider) ([][]byte, error) {
+	var recs [][]byte
+	err := scanSegment(bytes.NewReader(b), int64(len(b)), 1, keys, func(pos Position, rec []byte) error {
+		recs = append(recs, rec)
+		return nil
+	})
+	return recs, err
+}
+
+func FuzzScanSegment(f *testing.F) {
+	f.Add(segmentBytes(records(3), nil, nil))
+	f.Add(segmentBytes(records(5), Gzip, nil))
+	f.Add(segmentBytes(nil, nil, nil))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		recs, err := scanBytes(b, nil)
+		if err == nil {
+			return
+		}
+		ce, ok := err.(*CorruptionError)
+		if !ok {
+			return
+		}
+		// Whatever was read, plus what was reported, is the whole segment
+		read := ce.Offset
+		if ce.Offset > 0 && b[4] == 1 {
+			read = headerSize
+			for _, rec := range recs {
+				read += int64(frameSize + len(rec))
+			}
+		}
+		if read != ce.Offset || ce.Offset+ce.Size != int64(len(b)) {
+			t.Fatalf("Bad corruption report %v for a segment of %d bytes", ce, len(b))
+		}
+	})
+}
+
+func FuzzCorruption(f *testing.F) {
+	f.Add(uint(5), 20, byte(0xff))
+	f.Add(uint(3), 0, byte(0))
+	f.Add(uint(8), 100, byte(1))
+	f.Fuzz(func(t *testing.T, n uint, at int, x byte) {
+		recs := records(int(n % 20))
+		original := segmentBytes(recs, nil, nil)
+		if len(original) == 0 || x == 0 {
+			return
+		}
+		i := uint(at) % uint(len(original))
+		damaged := append([]byte(nil), original...)
+		damaged[i] ^= x
+
+		read, err := scanBytes(damaged, nil)
+		if len(read) > len(recs) {
+			t.Fatalf("More records read than written")
+		}
+		for i, rec := range read {
+			if !bytes.Equal(rec, recs[i]) {
+				t.Fatalf("Record %d was read damaged", i)
+			}
+		}
+		// Damage to the version byte makes the segment unsupported instead
+		if _, ok := err.(*CorruptionError); !ok && i != 4 {
+			t.Fatalf("The damage at %d should have been reported, got %v", i, err)
+		}
+	})
+}
+
+func TestJournalSync(t *testing.T) {
+	dir := "test-journal-sync"
+	defer os.RemoveAll(dir)
+
+	for _, opts := range []*Options{
+		{Dir: dir, Sync: SyncAlways},
+		{Dir: dir, Sync: SyncEvery, SyncEvents: 3},
+		{Dir: dir, Sync: SyncInterval, SyncInterval: time.Millisecond},
+	} {
+		j, err := Open(opts)
+		if err != nil {
+			t.Fatalf("Error opening journal: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := j.Append([]byte("Serenity"))
+				assert.Nil(t, err, "Should be nil")
+			}()
+		}
+		wg.Wait()
+
+		j.mtx.Lock()
+		switch opts.Sync {
+		case SyncAlways:
+			assert.Equal(t, j.appended, j.synced, "Every record should have been synced")
+		case SyncEvery:
+			assert.True(t, j.appended-j.synced < 3, "At most 2 records should be waiting for a sync")
+		}
+		j.mtx.Unlock()
+
+		if opts.Sync == SyncInterval {
+			time.Sleep(20 * time.Millisecond)
+			j.mtx.Lock()
+			assert.Equal(t, j.appended, j.synced, "Every record should have been synced")
+			j.mtx.Unlock()
+		}
+		assert.Nil(t, j.Close(), "Should be nil")
+	}
+
+	read, corrupted := scanAll(t, dir)
+	assert.Equal(t, 30, len(read), "Should hold this value")
+	assert.Empty(t, corrupted, "Nothing should be corrupted")
+}
+
+// Appends of 200 bytes from concurrent writers, which share the syncs
+func BenchmarkAppend(b *testing.B) {
+	rec := bytes.Repeat([]byte("x"), 200)
+	for _, bm := range []struct {
+		name string
+		opts Options
+	}{
+		{"Never", Options{Sync: SyncNever}},
+		{"Interval10ms", Options{Sync: SyncInterval, SyncInterval: 10 * time.Millisecond}},
+		{"Every100", Options{Sync: SyncEvery, SyncEvents: 100}},
+		{"Always", Options{Sync: SyncAlways}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			dir := "bench-journal"
+			defer os.RemoveAll(dir)
+
+			opts := bm.opts
+			opts.Dir = dir
+			j, err := Open(&opts)
+			if err != nil {
+				b.Fatalf("Error opening journal: %v", err)
+			}
+			b.SetBytes(int64(len(rec)))
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := j.Append(rec); err != nil {
+						b.Fatalf("Error appending: %v", err)
+					}
+				}
+			})
+			b.StopTimer()
+			j.Close()
+		})
+	}
+}
+
+func TestJournalMaintenance(t *testing.T) {
+	dir := "test-journal-maintenance"
+	defer os.RemoveAll(dir)
+
+	j, err := Open(&Options{Dir: dir, MaxSegmentSize: 100})
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	recs := records(10)
+	for _, rec := range recs {
+		_, err := j.Append(rec)
+		assert.Nil(t, err, "Should be nil")
+	}
+	assert.Nil(t, j.Close(), "Should be nil")
+
+	// Cut the last record in half
+	path := filepath.Join(dir, segmentName(4))
+	info, err := os.Stat(path)
+	assert.Nil(t, err, "Should be nil")
+	assert.Nil(t, os.Truncate(path, info.Size()-5), "Should be nil")
+
+	truncated, err := Truncate(dir, nil)
+	assert.Nil(t, err, "Should be nil")
+	assert.Equal(t, 1, len(truncated), "The torn record should have been cut")
+	read, corrupted := scanAll(t, dir)
+	assert.Equal(t, recs[:9], read, "The complete records should be left")
+	assert.Empty(t, corrupted, "Nothing should be corrupted")
+
+	kept, err := Compact(dir, nil, func(pos Position, rec []byte) bool {
+		return pos.Segment > 1
+	})
+	assert.Nil(t, err, "Should be nil")
+	assert.Equal(t, 6, kept, "The records after the first segment should be kept")
+	segments, err := listSegments(dir)
+	assert.Nil(t, err, "Should be nil")
+	assert.Equal(t, []uint64{5}, segments, "The records should be in a single segment")
+	read, _ = scanAll(t, dir)
+	assert.Equal(t, recs[3:9], read, "Should hold this value")
+}
+
+func TestJournalCompression(t *testing.T) {
+	dir := "test-journal-compression"
+	defer os.RemoveAll(dir)
+
+	recs := records(15)
+	write := func(recs [][]byte, codec Codec) []Position {
+		j, err := Open(&Options{Dir: dir, Codec: codec, BatchRecords: 4})
+		if err != nil {
+			t.Fatalf("Error opening journal: %v", err)
+		}
+		var positions []Position
+		for _, rec := range recs {
+			pos, err := j.Append(rec)
+			assert.Nil(t, err, "Should be nil")
+			positions = append(positions, pos)
+		}
+		assert.Nil(t, j.Close(), "Should be nil")
+		return positions
+	}
+
+	// Mixed compressed and uncompressed segments
+	write(recs[:3], nil)
+	positions := write(recs[3:13], Gzip)
+	write(recs[13:], nil)
+
+	assert.Equal(t, Position{Segment: 2, Offset: headerSize, Index: 3}, positions[3], "Should be the last record of the first batch")
+	assert.Equal(t, 0, positions[4].Index, "Should start a new batch")
+	assert.True(t, positions[4].Offset > headerSize, "Should hold this value")
+
+	var read [][]byte
+	var readPositions []Position
+	corrupted, err := ScanDir(dir, nil, func(pos Position, rec []byte) error {
+		read = append(read, rec)
+		if pos.Segment == 2 {
+			readPositions = append(readPositions, pos)
+		}
+		return nil
+	})
+	assert.Nil(t, err, "Should be nil")
+	assert.Empty(t, corrupted, "Nothing should be corrupted")
+	assert.Equal(t, recs, read, "Should read every record in order")
+	assert.Equal(t, positions, readPositions, "Should read the records where they were written")
+
+	// Repetitive records take less room
+	var compressed bytes.Buffer
+	format, _ := newSegmentFormat(1, Gzip, nil)
+	w, _ := newSegmentWriter(&compressed, format, defaultBatchRecords)
+	for _, rec := range records(100) {
+		w.add(rec)
+	}
+	assert.Nil(t, w.flush(), "Should be nil")
+	assert.True(t, compressed.Len() < len(segmentBytes(records(100), nil, nil))/4, "Records should have been compressed")
+
+	// Segments compressed with unknown codecs can't be read
+	b := segmentBytes(recs, Gzip, nil)
+	b[5] = 0xee
+	_, err = scanBytes(b, nil)
+	assert.NotNil(t, err, "Should fail")
+	_, ok := err.(*CorruptionError)
+	assert.False(t, ok, "Should not be taken as corrupted")
+}
+
+// tamper alters the first record of a segment, and fixes its checksum so only
+// the authentication can tell
+func tamper(t *testing.T, path string, headerLen int) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading segment: %v", err)
+	}
+	payload := b[headerLen+frameSize : headerLen+frameSize+int(binary.BigEndian.Uint32(b[headerLen:]))]
+	payload[len(payload)-1] ^= 1
+	binary.BigEndian.PutUint32(b[headerLen+4:], crc32.Checksum(payload, crcTable))
+	assert.Nil(t, ioutil.WriteFile(path, b, 0644), "Should be nil")
+}
+
+func TestJournalEncryption(t *testing.T) {
+	dir := "test-journal-encryption"
+	defer os.RemoveAll(dir)
+
+	keys := &StaticKeys{Current: "k1", Keys: map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+	}}
+	recs := records(6)
+	write := func(recs [][]byte, codec Codec) {
+		j, err := Open(&Options{Dir: dir, Codec: codec, Keys: keys})
+		if err != nil {
+			t.Fatalf("Error opening journal: %v", err)
+		}
+		for _, rec := range recs {
+			_, err := j.Append(rec)
+			assert.Nil(t, err, "Should be nil")
+		}
+		assert.Nil(t, j.Close(), "Should be nil")
+	}
+
+	// The key is rotated between the segments
+	write(recs[:3], nil)
+	keys.Keys["k2"] = bytes.Repeat([]byte{2}, 16)
+	keys.Current = "k2"
+	write(recs[3:], Gzip)
+
+	segment := filepath.Join(dir, segmentName(1))
+	b, err := ioutil.ReadFile(segment)
+	assert.Nil(t, err, "Should be nil")
+	assert.False(t, bytes.Contains(b, recs[0]), "Records should have been encrypted")
+
+	var read [][]byte
+	corrupted, err := ScanDir(dir, keys, func(pos Position, rec []byte) error {
+		read = append(read, rec)
+		return nil
+	})
+	assert.Nil(t, err, "Should be nil")
+	assert.Empty(t, corrupted, "Nothing should be corrupted")
+	assert.Equal(t, recs, read, "Should read every record with its key")
+
+	_, err = ScanDir(dir, nil, func(Position, []byte) error { return nil })
+	assert.NotNil(t, err, "Encrypted segments can't be read without keys")
+
+	// Reading fails closed on an altered record, which isn't truncated either
+	tamper(t, segment, headerSize+1+len("k1"))
+	_, err = ScanDir(dir, keys, func(Position, []byte) error { return nil })
+	ae, ok := err.(*AuthenticationError)
+	if assert.True(t, ok, "The altered record should fail the authentication") {
+		assert.Equal(t, uint64(1), ae.Segment, "Should hold this value")
+	}
+	_, err = Truncate(dir, keys)
+	assert.NotNil(t, err, "Should fail")
+	after, _ := ioutil.ReadFile(segment)
+	assert.Equal(t, len(b), len(after), "The segment should not have been cut")
+
+	// Nor on a damaged frame other than the last one
+	damaged := append([]byte(nil), b...)
+	damaged[headerSize+1+len("k1")+4] ^= 1
+	_, err = scanBytes(damaged, keys)
+	_, ok = err.(*AuthenticationError)
+	assert.True(t, ok, "The damaged frame should fail the authentication")
+	damaged = append([]byte(nil), b...)
+	damaged[headerSize+1+len("k1")+3]--
+	_, err = scanBytes(damaged, keys)
+	_, ok = err.(*AuthenticationError)
+	assert.True(t, ok, "The frame with a changed length should fail the authentication")
+	_, err = scanBytes(b[:len(b)-5], keys)
+	_, ok = err.(*CorruptionError)
+	assert.True(t, ok, "A torn frame should be corrupted")
+
+	// Records can't be moved around either
+	frames := b[headerSize+1+len("k1"):]
+	first := frames[:frameSize+int(binary.BigEndian.Uint32(frames))]
+	moved := append(append([]byte(nil), b[:headerSize+1+len("k1")]...), frames[len(first):]...)
+	moved = append(moved, first...)
+	_, err = scanBytes(moved, keys)
+	_, ok = err.(*AuthenticationError)
+	assert.True(t, ok, "The moved record should fail the authentication")
+}
+
+func TestJournalSize(t *testing.T) {
+	dir := "test-journal-size"
+	defer os.RemoveAll(dir)
+
+	j, err := Open(&Options{Dir: dir, MaxSegmentSize: 100, Retention: ArchiveReleased})
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	for _, rec := range records(10) {
+		_, err := j.Append(rec)
+		assert.Nil(t, err, "Should be nil")
+	}
+	onDisk := func() int64 {
+		size := int64(0)
+		files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+		for _, f := range files {
+			info, _ := os.Stat(f)
+			size += info.Size()
+		}
+		return size
+	}
+	assert.Equal(t, onDisk(), j.Size(), "Should count every segment")
+
+	// Evicted segments are deleted, even if released ones are archived
+	segments := j.Segments()
+	assert.Nil(t, j.Evict(segments[0]), "Should be nil")
+	assert.NotNil(t, j.Evict(segments[len(segments)-1]), "The current segment can't be evicted")
+	assert.Equal(t, onDisk(), j.Size(), "Should not count the evicted segment")
+	archived, _ := filepath.Glob(filepath.Join(dir, "archive", "*"))
+	assert.Empty(t, archived, "Should hold this value")
+	assert.Nil(t, j.Close(), "Should be nil")
+
+	free, err := FreeSpace(dir)
+	assert.Nil(t, err, "Should be nil")
+	assert.True(t, free > 0, "Should hold this value")
+}
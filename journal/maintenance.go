@@ -0,0 +1,92 @@
+// Maintenance of journals that aren't open
+
+package journal
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Truncate cuts the segments of the journal in the directory right after their
+// last valid record, and returns what was cut. Nothing is cut if a record fails
+// the authentication.
+func Truncate(dir string, keys KeyProvider) ([]*CorruptionError, error) {
+	corrupted, err := ScanDir(dir, keys, func(Position, []byte) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	for _, ce := range corrupted {
+		if err := os.Truncate(filepath.Join(dir, segmentName(ce.Segment)), ce.Offset); err != nil {
+			return nil, err
+		}
+	}
+	return corrupted, nil
+}
+
+// Compact replaces the segments of the journal in the directory with a single
+// one, with the valid records the function keeps, in the same order, compressed
+// like the last segment and encrypted with the current key, if there are keys.
+// The new segment is complete before the old ones are removed, so after a crash
+// the kept records can be both in the new segment and in the old ones.
+func Compact(dir string, keys KeyProvider, keep func(Position, []byte) bool) (int, error) {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(segments) == 0 {
+		return 0, nil
+	}
+
+	// The compacted segment is compressed like the last one
+	compacted := segments[len(segments)-1] + 1
+	codec, err := segmentCodec(filepath.Join(dir, segmentName(segments[len(segments)-1])))
+	if err != nil {
+		return 0, err
+	}
+	format, err := newSegmentFormat(compacted, codec, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	tmpPath := filepath.Join(dir, "compact.tmp")
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpPath)
+
+	kept := 0
+	w, err := newSegmentWriter(f, format, defaultBatchRecords)
+	if err == nil {
+		_, err = scanSegments(dir, segments, keys, func(pos Position, rec []byte) error {
+			if !keep(pos, rec) {
+				return nil
+			}
+			kept++
+			_, _, err := w.add(rec)
+			return err
+		})
+	}
+	if err == nil {
+		err = w.flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(dir, segmentName(compacted))); err != nil {
+		return 0, err
+	}
+	for _, n := range segments {
+		if err := os.Remove(filepath.Join(dir, segmentName(n))); err != nil {
+			return kept, err
+		}
+	}
+	return kept, nil
+}
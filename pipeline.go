@@ -14,20 +14,30 @@ package events
 
 import (
 	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getlantern/events-pipeline/journal"
 )
 
 type Pipeline struct {
 	Bolts map[string]Bolt
 	Wires []*Wire
 
-	init chan struct{}
-	stop chan struct{}
+	clock Clock
+	init  chan struct{}
+	stop  chan struct{}
+	// Stop only stops the pipeline once
+	stopOnce sync.Once
+	// The goroutines of the durable wires
+	durableWg sync.WaitGroup
 }
 
 func NewPipeline(sender Sender) *Pipeline {
 	p := &Pipeline{
 		Bolts: map[string]Bolt{sender.ID(): sender},
 		Wires: []*Wire{},
+		clock: SystemClock,
 		init:  make(chan struct{}),
 		stop:  make(chan struct{}),
 	}
@@ -37,17 +47,60 @@ func NewPipeline(sender Sender) *Pipeline {
 	return p
 }
 
+// SetClock replaces the clock given to the bolts. It must be called before Run.
+func (p *Pipeline) SetClock(c Clock) {
+	p.clock = c
+}
+
+func (p *Pipeline) Clock() Clock {
+	return p.clock
+}
+
+type WireOptions struct {
+	// Events that can be queued in the wire before senders block. Zero means
+	// that every send waits for the receivers.
+	BufferSize int
+	// Durable wires keep their events in a journal at Path until the receivers
+	// take them without errors, and deliver them again after a restart
+	Durable bool
+	Path    string
+	Sync    journal.SyncPolicy
+	// How often the events of a durable wire that failed to be delivered are
+	// queued again, and for how long. Defaults to a second and a minute.
+	RetryInterval    time.Duration
+	DeliveryDeadline time.Duration
+	// Gets the events given up on. They are only logged if not set.
+	DeadLetter func(evt *Event)
+}
+
 func (p *Pipeline) Plug(s Sender, r Receiver) (*Wire, error) {
-	evChan := make(chan *Event)
+	return p.PlugWithOptions(s, r, nil)
+}
+
+func (p *Pipeline) PlugWithOptions(s Sender, r Receiver, opts *WireOptions) (*Wire, error) {
+	if opts == nil {
+		opts = &WireOptions{}
+	}
+
+	evChan := make(chan *Event, opts.BufferSize)
 	wire := &Wire{
 		senders:   []Sender{},
 		receivers: []Receiver{},
 		events:    &evChan,
 	}
+	if opts.Durable {
+		q, err := openDurableQueue(opts)
+		if err != nil {
+			return nil, err
+		}
+		wire.queue = q
+	}
 
 	w, err := p.PlugWith(s, r, wire)
 	if err == nil {
 		p.Wires = append(p.Wires, wire)
+	} else if wire.queue != nil {
+		wire.queue.close()
 	}
 	return w, err
 }
@@ -89,6 +142,11 @@ func (p *Pipeline) PlugWith(s Sender, r Receiver, wire *Wire) (*Wire, error) {
 
 func (p *Pipeline) Run() {
 	// Initialization
+	for _, b := range p.Bolts {
+		if c, ok := b.(ClockAware); ok {
+			c.SetClock(p.clock)
+		}
+	}
 	if err := p.broadcastSysEvent(SystemEventInit); err != nil {
 		log.Errorf("Error broadcasting INIT system event: %v", err) //
 	}
@@ -97,7 +155,22 @@ func (p *Pipeline) Run() {
 		// Copy the reference to the wire
 		// Remove this line and you will unleash the wrath of the gods
 		wire := wire
+		if wire.queue != nil {
+			wire.queue.setClock(p.clock)
+			p.durableWg.Add(3)
+			go func() {
+				defer p.durableWg.Done()
+				wire.queue.replay(wire, p.stop)
+			}()
+			go func() {
+				defer p.durableWg.Done()
+				wire.queue.retry(wire, p.stop)
+			}()
+		}
 		go func() {
+			if wire.queue != nil {
+				defer p.durableWg.Done()
+			}
 			for {
 				// We always select on the stop signal at the end, so we make sure
 				// all wires are cleared of events before stopping.
@@ -106,20 +179,45 @@ func (p *Pipeline) Run() {
 				select {
 				case evt := <-*wire.events:
 					// Processing
+					// Feedback handlers get the successful deliveries, and error
+					// feedback handlers the failed ones
+					received := true
 					for _, rcv := range wire.receivers {
+						start := time.Now()
 						err := rcv.Receive(evt)
+						latency := time.Since(start)
 						if err != nil {
 							log.Errorf("Error receiving event: %v", err)
+							received = false
+						}
+						// Events replayed by durable wires have no sender
+						sb, ok := evt.sender.(*SenderBase)
+						if !ok || evt.Key == "" {
 							continue
 						}
-						if evt.sender.(*SenderBase).feedbackHandler != nil && evt.Key != "" {
-							err = evt.sender.(*SenderBase).feedbackHandler(evt)
+						handler := sb.feedbackHandler
+						if err != nil {
+							handler = sb.errorHandler
+						}
+						if handler != nil {
+							// The receiver may hold on to the event, so it's not touched
+							delivered := *evt
+							delivered.deliveryErr = err
+							delivered.latency = latency
+							err = handler(&delivered)
 							if err != nil {
 								log.Errorf("Error in feedback handler: %v", err)
 							}
-
 						}
 					}
+					// Durable wires keep the event until every receiver has it
+					if wire.queue != nil && received {
+						if err := wire.queue.ack(evt); err != nil {
+							log.Errorf("Error dequeuing event from durable wire: %v", err)
+						}
+					} else if wire.queue != nil {
+						wire.queue.fail(evt, p.clock.Now())
+					}
 				case <-p.stop:
 					return
 				}
@@ -129,12 +227,26 @@ func (p *Pipeline) Run() {
 }
 
 func (p *Pipeline) Stop() {
-	// Broadcast a system event to all receivers
-	if err := p.broadcastSysEvent(SystemEventStop); err != nil {
-		log.Errorf("Error broadcasting STOP system event: %v", err)
-	}
+	p.stopOnce.Do(func() {
+		// Broadcast a system event to all receivers
+		if err := p.broadcastSysEvent(SystemEventStop); err != nil {
+			log.Errorf("Error broadcasting STOP system event: %v", err)
+		}
+
+		// Every wire is listening
+		close(p.stop)
 
-	p.stop <- struct{}{}
+		// Events still queued are delivered again when the wires are plugged back,
+		// once the durable wires are done with the ones being delivered
+		p.durableWg.Wait()
+		for _, wire := range p.Wires {
+			if wire.queue != nil {
+				if err := wire.queue.close(); err != nil {
+					log.Errorf("Error closing durable wire: %v", err)
+				}
+			}
+		}
+	})
 }
 
 func (p *Pipeline) broadcastSysEvent(sysEvType SysEvent) error {
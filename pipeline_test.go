@@ -1,6 +1,10 @@
 package events
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -48,6 +52,82 @@ func (s *NullSink) Receive(evt *Event) error {
 	return s.SinkBase.Receive(evt)
 }
 
+// Test Clock
+// Time only moves when told to, firing the tickers that are due
+type testClock struct {
+	now     time.Time
+	tickers []*testTicker
+	mtx     sync.Mutex
+}
+
+type testTicker struct {
+	clock   *testClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *testClock) NewTicker(d time.Duration) Ticker {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t := &testTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		if t.stopped || t.next.After(c.now) {
+			continue
+		}
+		for !t.next.After(c.now) {
+			t.next = t.next.Add(t.period)
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+}
+
+// Waits until the clock has some ticker
+func (c *testClock) WaitForTickers(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		c.mtx.Lock()
+		n := len(c.tickers)
+		c.mtx.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("No ticker was created")
+}
+
+func (t *testTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *testTicker) Stop() {
+	t.clock.mtx.Lock()
+	t.stopped = true
+	t.clock.mtx.Unlock()
+}
+
 func TestTrivialPipeline(t *testing.T) {
 	t.SkipNow()
 
@@ -161,3 +241,201 @@ func TestAddDoubleConnect(t *testing.T) {
 	assert.Equal(t, 1, len(emitter.outlets))
 	assert.Equal(t, 1, len(sink.inlets))
 }
+
+// Error Sink
+type ErrorSink struct {
+	*SinkBase
+}
+
+func NewErrorSink(id string) *ErrorSink {
+	return &ErrorSink{
+		SinkBase: NewSinkBase(id),
+	}
+}
+
+func (s *ErrorSink) Receive(evt *Event) error {
+	if evt.Key == "" {
+		return nil
+	}
+	return fmt.Errorf("Failed to receive event %v", evt.Key)
+}
+
+func TestFeedbackOnError(t *testing.T) {
+	acks := make(chan *Event, 2)
+	errs := make(chan error, 2)
+
+	emitter := NewEmitterBase("test-emitter", func(e *Event) error {
+		acks <- e
+		return nil
+	})
+	emitter.SetErrorFeedback(func(e *Event) error {
+		errs <- e.DeliveryError()
+		return nil
+	})
+	sink := NewErrorSink("test-sink")
+	pipeline := NewPipeline(emitter)
+	_, err := pipeline.Plug(emitter, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+
+	emitter.Emit("Key A", &Vals{})
+	time.Sleep(time.Millisecond * 20)
+
+	assert.Equal(t, 0, len(acks), "The feedback should only get successful deliveries")
+	assert.Equal(t, 1, len(errs), "The error feedback should have been called")
+	assert.NotNil(t, <-errs, "The error feedback should get the delivery error")
+
+	pipeline.Stop()
+}
+
+func TestBufferedWire(t *testing.T) {
+	emitter := NewEmitterBase("test-emitter", nil)
+	sink := NewNullSink("test-sink")
+	pipeline := NewPipeline(emitter)
+	wire, err := pipeline.PlugWithOptions(emitter, sink, &WireOptions{BufferSize: 2})
+	assert.Nil(t, err, "Should be nil")
+	assert.Equal(t, 2, wire.Cap(), "Should hold this value")
+
+	// Nothing is receiving yet, but the events fit in the buffer
+	emitter.Emit("Key A", &Vals{})
+	emitter.Emit("Key B", &Vals{})
+	assert.Equal(t, 2, wire.Len(), "The events should be queued")
+
+	pipeline.Run()
+	time.Sleep(time.Millisecond * 20)
+	assert.Equal(t, 0, wire.Len(), "The events should have been received")
+
+	pipeline.Stop()
+}
+
+// Records the events it gets, failing on the ones in fail
+type recordingSink struct {
+	*SinkBase
+	fail   map[Key]bool
+	events chan *Event
+}
+
+func (s *recordingSink) Receive(evt *Event) error {
+	if evt.Key == "" {
+		return nil
+	}
+	s.events <- evt
+	if s.fail[evt.Key] {
+		return fmt.Errorf("Failed to receive event %v", evt.Key)
+	}
+	return nil
+}
+
+func TestDurableWire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durablewire")
+	assert.Nil(t, err, "Should be nil")
+	defer os.RemoveAll(dir)
+
+	start := func(opts *WireOptions, fail map[Key]bool) (*Pipeline, *Wire, *recordingSink) {
+		emitter := NewEmitterBase("test-emitter", nil)
+		sink := &recordingSink{SinkBase: NewSinkBase("test-sink"), fail: fail, events: make(chan *Event, 100)}
+		pipeline := NewPipeline(emitter)
+		pipeline.SetClock(newTestClock())
+		opts.Durable, opts.Path = true, dir
+		wire, err := pipeline.PlugWithOptions(emitter, sink, opts)
+		if err != nil {
+			t.Fatalf("Error plugging durable wire: %v", err)
+		}
+		return pipeline, wire, sink
+	}
+	run := func(pipeline *Pipeline, emit ...Key) {
+		pipeline.Run()
+		emitter := pipeline.Bolts["test-emitter"].(*EmitterBase)
+		for _, k := range emit {
+			assert.Nil(t, emitter.Emit(k, &Vals{}), "Should be nil")
+		}
+	}
+	receive := func(sink *recordingSink, n int) []Key {
+		var keys []Key
+		for i := 0; i < n; i++ {
+			select {
+			case evt := <-sink.events:
+				keys = append(keys, evt.Key)
+			case <-time.After(time.Second):
+				t.Fatalf("Only %v events reached the sink", i)
+			}
+		}
+		return keys
+	}
+	recovered := func(wire *Wire) []*Event {
+		wire.queue.mtx.Lock()
+		defer wire.queue.mtx.Unlock()
+		return wire.queue.recovered
+	}
+
+	// The failed event is retried, and the ones after it taken out of the queue
+	pipeline, _, sink := start(&WireOptions{RetryInterval: 10 * time.Millisecond}, map[Key]bool{"Key B": true})
+	run(pipeline, "Key A", "Key B", "Key C")
+	assert.Equal(t, []Key{"Key A", "Key B", "Key C"}, receive(sink, 3), "Every event should have been delivered")
+	clock := pipeline.Clock().(*testClock)
+	clock.WaitForTickers(t)
+	clock.Advance(10 * time.Millisecond)
+	assert.Equal(t, []Key{"Key B"}, receive(sink, 1), "The failed event should have been retried")
+	pipeline.Stop()
+
+	// Only the failed event is delivered again
+	pipeline, wire, sink := start(&WireOptions{}, nil)
+	if evts := recovered(wire); assert.Equal(t, 1, len(evts), "Only the failed event should be recovered") {
+		assert.Equal(t, Key("Key B"), evts[0].Key, "Should hold this value")
+	}
+	run(pipeline)
+	select {
+	case evt := <-sink.events:
+		assert.Equal(t, Key("Key B"), evt.Key, "The event not received should be delivered again")
+		if assert.NotNil(t, evt.Replay, "Should be marked as replayed") {
+			assert.Equal(t, 1, evt.Replay.Count, "Should be the first replay")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("The event not received wasn't delivered again")
+	}
+	pipeline.Stop()
+
+	pipeline, wire, sink = start(&WireOptions{}, nil)
+	assert.Empty(t, recovered(wire), "Nothing should be recovered")
+	run(pipeline, "Key D")
+	select {
+	case evt := <-sink.events:
+		assert.Equal(t, Key("Key D"), evt.Key, "Only the new event should be delivered")
+		assert.Nil(t, evt.Replay, "Should not be marked as replayed")
+	case <-time.After(time.Second):
+		t.Fatalf("The new event wasn't delivered")
+	}
+	pipeline.Stop()
+
+	// Events failing past the deadline are given up on
+	deadLetter := make(chan Key, 10)
+	pipeline, _, sink = start(&WireOptions{
+		RetryInterval:    10 * time.Millisecond,
+		DeliveryDeadline: 20 * time.Millisecond,
+		DeadLetter:       func(evt *Event) { deadLetter <- evt.Key },
+	}, map[Key]bool{"Key E": true})
+	run(pipeline, "Key E", "Key F")
+	receive(sink, 2)
+	clock = pipeline.Clock().(*testClock)
+	clock.WaitForTickers(t)
+	clock.Advance(20 * time.Millisecond)
+	select {
+	case k := <-deadLetter:
+		assert.Equal(t, Key("Key E"), k, "The failed event should have been given up on")
+	case <-time.After(time.Second):
+		t.Fatalf("The failed event wasn't given up on")
+	}
+	pipeline.Stop()
+	assert.Equal(t, 0, len(sink.events), "The event given up on should not have been retried")
+
+	pipeline, wire, _ = start(&WireOptions{}, nil)
+	assert.Empty(t, recovered(wire), "Nothing should be delivered again")
+	run(pipeline)
+	pipeline.Stop()
+	pipeline.Stop()
+
+	_, err = NewPipeline(NewEmitterBase("test-emitter", nil)).PlugWithOptions(
+		NewEmitterBase("test-emitter", nil), NewNullSink("test-sink"), &WireOptions{Durable: true})
+	assert.NotNil(t, err, "Durable wires should need a path")
+}
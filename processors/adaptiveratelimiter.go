@@ -0,0 +1,280 @@
+// An adaptive rate limiter lets through up to a number of events per second that
+// follows the health of the bolts downstream, AIMD style: at the end of every
+// interval the rate grows by Increase if nothing signaled congestion, or is
+// multiplied by Decrease if something did, always between Floor and Ceiling.
+// The congestion signals are the events queued in the outlet wires, and the
+// errors and latency of the deliveries, as reported through the feedback.
+// Every change of rate is sent as an event with the RateChangeKey.
+
+package processors
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	events "github.com/getlantern/events-pipeline"
+)
+
+const DefaultRateChangeKey = "rate_change"
+
+// Vals of the rate change events
+const (
+	RateVal         = "rate"
+	PreviousRateVal = "previous_rate"
+	// One of the congestion signals, or RateIncreased
+	RateChangeReasonVal = "reason"
+)
+
+// Reasons of the rate changes
+const (
+	CongestionQueueDepth = "queue_depth"
+	CongestionErrors     = "errors"
+	CongestionLatency    = "latency"
+	RateIncreased        = "increase"
+)
+
+type AdaptiveRateLimiterOptions struct {
+	// Limits of the rate, in events per second
+	Floor   float64
+	Ceiling float64
+	// Defaults to the ceiling
+	Initial float64
+	// How often the rate is adjusted. Defaults to a second.
+	Interval time.Duration
+	// Added to the rate after an interval without congestion. Defaults to a
+	// tenth of the ceiling.
+	Increase float64
+	// Factor applied to the rate after an interval with congestion. Defaults to 0.5.
+	Decrease float64
+
+	// Events queued in the outlet wires, which need a buffer, to signal congestion.
+	// Zero disables the signal.
+	MaxQueueDepth int
+	// Fraction of failed deliveries in an interval tolerated. Zero means that any
+	// error signals congestion.
+	MaxErrorRatio float64
+	// Average delivery latency in an interval to signal congestion. Zero disables
+	// the signal.
+	MaxLatency time.Duration
+
+	// Defaults to DefaultRateChangeKey
+	RateChangeKey events.Key
+	// Defaults to the pipeline clock
+	Clock events.Clock
+}
+
+// What has been seen downstream during the current interval
+type deliveryStats struct {
+	deliveries int64
+	errors     int64
+	latency    time.Duration
+	maxQueued  int
+}
+
+type AdaptiveRateLimiter struct {
+	*events.ProcessorBase
+	options *AdaptiveRateLimiterOptions
+	clock   events.Clock
+
+	rule   RateLimitRule
+	bucket tokenBucket
+	stats  deliveryStats
+	mtx    sync.Mutex
+
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func NewAdaptiveRateLimiter(id string, opts *AdaptiveRateLimiterOptions) *AdaptiveRateLimiter {
+	if opts.Floor <= 0 || opts.Ceiling < opts.Floor {
+		panic("Adaptive rate limits must be positive, and the floor not above the ceiling")
+	}
+	if opts.Initial == 0 {
+		opts.Initial = opts.Ceiling
+	}
+	opts.Initial = math.Max(opts.Floor, math.Min(opts.Ceiling, opts.Initial))
+	if opts.Interval == 0 {
+		opts.Interval = time.Second
+	}
+	if opts.Increase == 0 {
+		opts.Increase = opts.Ceiling / 10
+	}
+	if opts.Decrease == 0 {
+		opts.Decrease = 0.5
+	}
+	if opts.Decrease >= 1 {
+		panic("The rate decrease factor must be below 1")
+	}
+	if opts.RateChangeKey == "" {
+		opts.RateChangeKey = DefaultRateChangeKey
+	}
+
+	clock := opts.Clock
+	if clock == nil {
+		clock = events.SystemClock
+	}
+
+	r := &AdaptiveRateLimiter{
+		options: opts,
+		clock:   clock,
+	}
+	r.setRate(opts.Initial)
+	r.bucket.Tokens = r.rule.Burst
+	r.ProcessorBase = events.NewProcessorBase(id, r.feedback)
+	r.SetErrorFeedback(r.feedback)
+	return r
+}
+
+func (r *AdaptiveRateLimiter) SetClock(c events.Clock) {
+	if r.options.Clock == nil {
+		r.clock = c
+	}
+}
+
+// Rate returns the number of events per second currently allowed
+func (r *AdaptiveRateLimiter) Rate() float64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.rule.Rate
+}
+
+func (r *AdaptiveRateLimiter) Receive(evt *events.Event) error {
+	log.Tracef("ADAPTIVE RATELIMITER ID %v PROCESSED event: %v with: %v", r.ID(), evt.Key, evt.Vals)
+
+	// Handle the SystemEvent signals
+	if evt.Key == "" {
+		if _, ok := evt.Vals[string(events.SystemEventInit)]; ok {
+			r.start()
+		} else if _, ok := evt.Vals[string(events.SystemEventStop)]; ok {
+			if r.stop != nil {
+				close(r.stop)
+				r.stopped.Wait()
+				r.stop = nil
+			}
+		}
+		return nil
+	}
+
+	err := r.ProcessorBase.Receive(evt)
+	if err != nil {
+		return err
+	}
+
+	queued := r.queued()
+	r.mtx.Lock()
+	if queued > r.stats.maxQueued {
+		r.stats.maxQueued = queued
+	}
+	allowed := r.bucket.take(&r.rule, r.clock.Now())
+	r.mtx.Unlock()
+
+	if !allowed {
+		return nil
+	}
+	return r.ProcessorBase.Send(evt)
+}
+
+func (r *AdaptiveRateLimiter) queued() int {
+	n := 0
+	for _, w := range r.ProcessorBase.Outlets() {
+		n += w.Len()
+	}
+	return n
+}
+
+func (r *AdaptiveRateLimiter) feedback(evt *events.Event) error {
+	if evt.Key == r.options.RateChangeKey {
+		return nil
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.stats.deliveries++
+	if evt.DeliveryError() != nil {
+		r.stats.errors++
+	}
+	r.stats.latency += evt.DeliveryLatency()
+	return nil
+}
+
+func (r *AdaptiveRateLimiter) start() {
+	if r.stop != nil {
+		return
+	}
+
+	r.stop = make(chan struct{})
+	r.stopped.Add(1)
+	go func(stop chan struct{}) {
+		defer r.stopped.Done()
+
+		ticker := r.clock.NewTicker(r.options.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.Chan():
+				r.adjust()
+			case <-stop:
+				return
+			}
+		}
+	}(r.stop)
+}
+
+// congestion returns the first congestion signal seen in the interval, if any
+func (r *AdaptiveRateLimiter) congestion(s *deliveryStats) string {
+	switch {
+	case r.options.MaxQueueDepth > 0 && s.maxQueued >= r.options.MaxQueueDepth:
+		return CongestionQueueDepth
+	case s.errors > 0 && float64(s.errors)/float64(s.deliveries) > r.options.MaxErrorRatio:
+		return CongestionErrors
+	case r.options.MaxLatency > 0 && s.deliveries > 0 &&
+		s.latency/time.Duration(s.deliveries) >= r.options.MaxLatency:
+		return CongestionLatency
+	}
+	return ""
+}
+
+// adjust changes the rate at the end of an interval
+func (r *AdaptiveRateLimiter) adjust() {
+	queued := r.queued()
+
+	r.mtx.Lock()
+	stats := r.stats
+	r.stats = deliveryStats{}
+	if queued > stats.maxQueued {
+		stats.maxQueued = queued
+	}
+
+	previous := r.rule.Rate
+	reason := r.congestion(&stats)
+	if reason != "" {
+		r.setRate(math.Max(r.options.Floor, previous*r.options.Decrease))
+	} else {
+		reason = RateIncreased
+		r.setRate(math.Min(r.options.Ceiling, previous+r.options.Increase))
+	}
+	rate := r.rule.Rate
+	r.mtx.Unlock()
+
+	if rate == previous {
+		return
+	}
+	log.Debugf("Adaptive rate limiter %v changed its rate from %v to %v: %v", r.ID(), previous, rate, reason)
+	err := r.ProcessorBase.Send(events.NewEvent(r.options.RateChangeKey, &events.Vals{
+		RateVal:             rate,
+		PreviousRateVal:     previous,
+		RateChangeReasonVal: reason,
+	}))
+	if err != nil {
+		log.Errorf("Error sending event")
+	}
+}
+
+// setRate must be called with the lock held. The burst allowed is a second's worth.
+func (r *AdaptiveRateLimiter) setRate(rate float64) {
+	r.rule.Rate = rate
+	r.rule.Burst = math.Max(rate, 1)
+	r.bucket.Tokens = math.Min(r.bucket.Tokens, r.rule.Burst)
+}
@@ -1,9 +1,20 @@
 package processors
 
 import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
 	events "github.com/getlantern/events-pipeline"
 )
 
+// Value given to the group-by fields of the events aggregated in the overflow group
+const OverflowGroup = "_overflow"
+
+// Internal key of the overflow group, which cannot clash with a regular group key
+const overflowGroupKey = "\x00overflow"
+
 type AggregationDirective struct {
 	Key            events.Key
 	Val            string
@@ -11,27 +22,149 @@ type AggregationDirective struct {
 	Identity       interface{}
 }
 
+// More settings of a directive. They are apart from AggregationDirective so that
+// its literals without field names still compile.
+type AggregationDirectiveOptions struct {
+	// Field where the aggregated value is written. Defaults to Val, but needs to be
+	// set when several directives aggregate the same field.
+	Output string
+
+	// Aggregate separately each combination of values of these fields
+	GroupBy []string
+	// Once this many groups exist, new combinations are aggregated together in
+	// an overflow group. Zero means no limit.
+	MaxGroups int
+}
+
+type directive struct {
+	AggregationDirective
+	AggregationDirectiveOptions
+}
+
+// withOptions pairs every directive with its options, given in the same order
+func withOptions(ds []AggregationDirective, opts []AggregationDirectiveOptions) []directive {
+	if len(opts) > len(ds) {
+		panic("There are more directive options than directives")
+	}
+	dirs := make([]directive, len(ds))
+	for i, d := range ds {
+		dirs[i].AggregationDirective = d
+		if i < len(opts) {
+			dirs[i].AggregationDirectiveOptions = opts[i]
+		}
+	}
+	return dirs
+}
+
+func (d *directive) output() string {
+	if d.Output != "" {
+		return d.Output
+	}
+	return d.Val
+}
+
+// groupOf returns the key of the group an event belongs to, and the values of its
+// group-by fields. The event goes to the overflow group if its own group does not
+// exist and the limit has been reached.
+func (d *directive) groupOf(vals events.Vals, exists func(string) bool, numGroups int) (string, events.Vals) {
+	if len(d.GroupBy) == 0 {
+		return "", nil
+	}
+
+	fields := make(events.Vals, len(d.GroupBy))
+	parts := make([]string, len(d.GroupBy))
+	for i, f := range d.GroupBy {
+		v := vals[f]
+		fields[f] = v
+		parts[i] = fmt.Sprintf("%T:%v", v, v)
+	}
+	key := strings.Join(parts, "\x1f")
+
+	if d.MaxGroups > 0 && numGroups >= d.MaxGroups && !exists(key) {
+		for _, f := range d.GroupBy {
+			fields[f] = OverflowGroup
+		}
+		return overflowGroupKey, fields
+	}
+	return key, fields
+}
+
+type aggregationGroup struct {
+	accum  interface{}
+	value  interface{}
+	fields events.Vals
+}
+
+type aggregationGroups map[string]*aggregationGroup
+
+func (gs aggregationGroups) exists(key string) bool {
+	_, ok := gs[key]
+	return ok
+}
+
+type AggregatorMode int
+
+const (
+	// Replace the aggregated values in the passing events
+	AggregatorMutate AggregatorMode = iota
+	// Leave the passing events alone, and emit separate summary events
+	AggregatorSummarize
+)
+
+// Appended to the key of the aggregated events to get the key of their summaries
+const SummaryKeySuffix = ".summary"
+
+type AggregatorOptions struct {
+	Mode AggregatorMode
+	// In summary mode, drop the aggregated events instead of passing them through
+	DropAggregated bool
+	// Summarize when a SystemEventMark is received
+	SummarizeOnMark bool
+	// Summarize periodically. Zero means never.
+	Interval time.Duration
+	// Derives the key of the summary events. Defaults to appending SummaryKeySuffix.
+	SummaryKey func(events.Key) events.Key
+	// Options of the directives, in the same order. The ones past the end of the
+	// list have none.
+	Directives []AggregationDirectiveOptions
+}
+
 type Aggregator struct {
 	*events.ProcessorBase
+	options *AggregatorOptions
 
-	directives    []AggregationDirective
-	currentValues []interface{}
+	directives []directive
+	groups     []aggregationGroups
+	mtx        sync.Mutex
+
+	clock events.Clock
+	stop  chan struct{}
 }
 
 func NewAggregator(id string, ds ...AggregationDirective) *Aggregator {
-	initValues := make([]interface{}, len(ds))
-	for i, d := range ds {
-		initValues[i] = d.Identity
-	}
+	return NewAggregatorWithOptions(id, &AggregatorOptions{}, ds...)
+}
 
-	// TODO: signal restart of aggregation
-	var feedback events.FeedbackFunc
+func NewAggregatorWithOptions(id string, opts *AggregatorOptions, ds ...AggregationDirective) *Aggregator {
+	if opts.SummaryKey == nil {
+		opts.SummaryKey = func(k events.Key) events.Key {
+			return k + SummaryKeySuffix
+		}
+	}
 
-	return &Aggregator{
-		ProcessorBase: events.NewProcessorBase(id, feedback),
-		currentValues: initValues,
-		directives:    ds,
+	a := &Aggregator{
+		ProcessorBase: events.NewProcessorBase(id, nil),
+		options:       opts,
+		directives:    withOptions(ds, opts.Directives),
+		clock:         events.SystemClock,
 	}
+	a.reset()
+
+	return a
+}
+
+func (a *Aggregator) SetClock(c events.Clock) {
+	a.clock = c
 }
 
 func (a *Aggregator) Receive(evt *events.Event) error {
@@ -39,6 +172,19 @@ func (a *Aggregator) Receive(evt *events.Event) error {
 
 	// Handle the SystemEvent signals
 	if evt.Key == "" {
+		if _, ok := evt.Vals[string(events.SystemEventInit)]; ok {
+			a.start()
+		} else if _, ok := evt.Vals[string(events.SystemEventStop)]; ok {
+			if a.stop != nil {
+				close(a.stop)
+				a.stop = nil
+			}
+			if a.options.Mode == AggregatorSummarize {
+				return a.Summarize()
+			}
+		} else if _, ok := evt.Vals[string(events.SystemEventMark)]; ok && a.options.SummarizeOnMark {
+			return a.Summarize()
+		}
 		return nil
 	}
 
@@ -47,20 +193,122 @@ func (a *Aggregator) Receive(evt *events.Event) error {
 		return err
 	}
 
-	// There can be more than one directive with the same key, so we need to iterate
-	// over all of them. An alternatige would be to key on both Key and Val.
-	for i, d := range a.directives {
+	// There can be more than one directive with the same key, so we need to apply
+	// all of them. They all see the values as they arrived, even if a previous
+	// directive wrote its output to a field used by another one.
+	mutate := a.options.Mode == AggregatorMutate
+	matched := false
+	raw := make(events.Vals)
+	for _, d := range a.directives {
 		if evt.Key == d.Key {
 			if val, ok := evt.Vals[d.Val]; ok {
-				a.currentValues[i], evt.Vals[d.Val] = d.AggregatorFunc(a.currentValues[i], val)
+				raw[d.Val] = val
 			}
-			break
 		}
 	}
 
+	a.mtx.Lock()
+	for i, d := range a.directives {
+		if evt.Key == d.Key {
+			matched = true
+			if val, ok := raw[d.Val]; ok {
+				gs := a.groups[i]
+				key, fields := d.groupOf(evt.Vals, gs.exists, len(gs))
+				g, ok := gs[key]
+				if !ok {
+					g = &aggregationGroup{accum: d.Identity, fields: fields}
+					gs[key] = g
+				}
+				g.accum, g.value = d.AggregatorFunc(g.accum, val)
+				if mutate {
+					evt.Vals[d.output()] = g.value
+					if key == overflowGroupKey {
+						for f, v := range fields {
+							evt.Vals[f] = v
+						}
+					}
+				}
+			}
+		}
+	}
+	a.mtx.Unlock()
+
+	if matched && !mutate && a.options.DropAggregated {
+		return nil
+	}
 	return a.ProcessorBase.Send(evt)
 }
 
+// Summarize emits an event with the current aggregated value of every directive
+// and group, followed by a SystemEventMark, and restarts the aggregation
+func (a *Aggregator) Summarize() error {
+	a.mtx.Lock()
+	// Directives of the same key and group-by fields share the summaries of
+	// their groups
+	type summaryID struct {
+		key     events.Key
+		groupBy string
+		group   string
+	}
+	var summaries []*events.Event
+	byID := make(map[summaryID]*events.Event)
+	for i, d := range a.directives {
+		for group, g := range a.groups[i] {
+			id := summaryID{a.options.SummaryKey(d.Key), strings.Join(d.GroupBy, "\x1f"), group}
+			evt, ok := byID[id]
+			if !ok {
+				vals := make(events.Vals, len(g.fields)+1)
+				for f, v := range g.fields {
+					vals[f] = v
+				}
+				evt = events.NewEvent(id.key, &vals)
+				byID[id] = evt
+				summaries = append(summaries, evt)
+			}
+			evt.Vals[d.output()] = g.value
+		}
+	}
+	a.reset()
+	a.mtx.Unlock()
+
+	for _, evt := range summaries {
+		if err := a.ProcessorBase.Send(evt); err != nil {
+			return err
+		}
+	}
+	return a.ProcessorBase.Send(events.NewEvent("", &events.Vals{string(events.SystemEventMark): nil}))
+}
+
+// Must be called with the lock held, unless nobody else can see the aggregator yet
+func (a *Aggregator) reset() {
+	a.groups = make([]aggregationGroups, len(a.directives))
+	for i := range a.directives {
+		a.groups[i] = make(aggregationGroups)
+	}
+}
+
+func (a *Aggregator) start() {
+	if a.options.Interval == 0 || a.stop != nil {
+		return
+	}
+
+	a.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := a.clock.NewTicker(a.options.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.Chan():
+				if err := a.Summarize(); err != nil {
+					log.Errorf("Error emitting summaries: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(a.stop)
+}
+
 // Predefined identity values
 
 var (
@@ -0,0 +1,569 @@
+// Aggregator functions with mergeable states.
+// Their accumulators start as nil (so their directives need a nil Identity),
+// and are created on the first value aggregated. States of the same function
+// can be merged, which is how windows, groups, checkpoints or even different
+// processes combine partial results.
+// All of them take numeric values, except the distinct count, and ignore
+// values of any other type.
+
+package processors
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+type MergeableState interface {
+	// Merge adds the other state, which must be of the same kind, to this one
+	Merge(other MergeableState) error
+	// Value returns the aggregated value, as the aggregator function would
+	Value() interface{}
+}
+
+func init() {
+	gob.Register(&CountState{})
+	gob.Register(&MinState{})
+	gob.Register(&MaxState{})
+	gob.Register(&MomentsState{})
+	gob.Register(&EWMAState{})
+	gob.Register(&QuantileState{})
+	gob.Register(&DistinctState{})
+}
+
+// MergeStates combines two accumulators of the same aggregator function into a
+// new one, leaving both untouched. Besides the mergeable states, it supports the
+// accumulators of the running sums and the moving average.
+func MergeStates(a, b interface{}) (interface{}, error) {
+	if a == nil {
+		return copyState(b)
+	}
+	if b == nil {
+		return copyState(a)
+	}
+
+	switch ta := a.(type) {
+	case int:
+		if tb, ok := b.(int); ok {
+			return ta + tb, nil
+		}
+	case float64:
+		if tb, ok := b.(float64); ok {
+			return ta + tb, nil
+		}
+	case []float64:
+		if tb, ok := b.([]float64); ok && len(ta) == 2 && len(tb) == 2 {
+			n := ta[0] + tb[0]
+			if n == 0 {
+				return []float64{0, 0}, nil
+			}
+			return []float64{n, (ta[0]*ta[1] + tb[0]*tb[1]) / n}, nil
+		}
+	case MergeableState:
+		if tb, ok := b.(MergeableState); ok {
+			c, err := copyState(ta)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.(MergeableState).Merge(tb); err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("Cannot merge aggregation states of types %T and %T", a, b)
+}
+
+// copyState returns a copy of an accumulator that doesn't share anything with
+// it. Mergeable states other than the ones here are copied with gob, so they
+// must be registered.
+func copyState(x interface{}) (interface{}, error) {
+	switch t := x.(type) {
+	case nil, int, float64:
+		return t, nil
+	case []float64:
+		return append([]float64(nil), t...), nil
+	case *CountState:
+		c := *t
+		return &c, nil
+	case *MinState:
+		c := *t
+		return &c, nil
+	case *MaxState:
+		c := *t
+		return &c, nil
+	case *MomentsState:
+		c := *t
+		return &c, nil
+	case *EWMAState:
+		c := *t
+		return &c, nil
+	case *QuantileState:
+		c := *t
+		c.Positive = make(map[int]uint64, len(t.Positive))
+		for i, n := range t.Positive {
+			c.Positive[i] = n
+		}
+		c.Negative = make(map[int]uint64, len(t.Negative))
+		for i, n := range t.Negative {
+			c.Negative[i] = n
+		}
+		return &c, nil
+	case *DistinctState:
+		return &DistinctState{Registers: append([]uint8(nil), t.Registers...)}, nil
+	case MergeableState:
+		var b bytes.Buffer
+		if err := gob.NewEncoder(&b).Encode(&x); err != nil {
+			return nil, fmt.Errorf("Cannot copy aggregation state of type %T: %v", x, err)
+		}
+		var c interface{}
+		if err := gob.NewDecoder(&b).Decode(&c); err != nil {
+			return nil, fmt.Errorf("Cannot copy aggregation state of type %T: %v", x, err)
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("Cannot copy aggregation state of type %T", x)
+}
+
+func toFloat64(x interface{}) (float64, bool) {
+	switch t := x.(type) {
+	case float64:
+		return t, true
+	case float32:
+		return float64(t), true
+	case int:
+		return float64(t), true
+	case int8:
+		return float64(t), true
+	case int16:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case uint:
+		return float64(t), true
+	case uint8:
+		return float64(t), true
+	case uint16:
+		return float64(t), true
+	case uint32:
+		return float64(t), true
+	case uint64:
+		return float64(t), true
+	}
+	return 0, false
+}
+
+func mergeError(a, b MergeableState) error {
+	return fmt.Errorf("Cannot merge aggregation states %T and %T", a, b)
+}
+
+// Count
+
+type CountState struct {
+	N int64
+}
+
+func (s *CountState) Merge(other MergeableState) error {
+	o, ok := other.(*CountState)
+	if !ok {
+		return mergeError(s, other)
+	}
+	s.N += o.N
+	return nil
+}
+
+func (s *CountState) Value() interface{} {
+	return s.N
+}
+
+func AggregatorCount(accum, x interface{}) (accum2, x2 interface{}) {
+	s, ok := accum.(*CountState)
+	if !ok {
+		s = &CountState{}
+	}
+	s.N++
+	return s, s.Value()
+}
+
+// Min and Max
+
+type MinState struct {
+	Min float64
+	Set bool
+}
+
+func (s *MinState) Merge(other MergeableState) error {
+	o, ok := other.(*MinState)
+	if !ok {
+		return mergeError(s, other)
+	}
+	if o.Set && (!s.Set || o.Min < s.Min) {
+		s.Min, s.Set = o.Min, true
+	}
+	return nil
+}
+
+func (s *MinState) Value() interface{} {
+	return s.Min
+}
+
+func AggregatorMin(accum, x interface{}) (accum2, x2 interface{}) {
+	s, ok := accum.(*MinState)
+	if !ok {
+		s = &MinState{}
+	}
+	if v, ok := toFloat64(x); ok && (!s.Set || v < s.Min) {
+		s.Min, s.Set = v, true
+	}
+	return s, s.Value()
+}
+
+type MaxState struct {
+	Max float64
+	Set bool
+}
+
+func (s *MaxState) Merge(other MergeableState) error {
+	o, ok := other.(*MaxState)
+	if !ok {
+		return mergeError(s, other)
+	}
+	if o.Set && (!s.Set || o.Max > s.Max) {
+		s.Max, s.Set = o.Max, true
+	}
+	return nil
+}
+
+func (s *MaxState) Value() interface{} {
+	return s.Max
+}
+
+func AggregatorMax(accum, x interface{}) (accum2, x2 interface{}) {
+	s, ok := accum.(*MaxState)
+	if !ok {
+		s = &MaxState{}
+	}
+	if v, ok := toFloat64(x); ok && (!s.Set || v > s.Max) {
+		s.Max, s.Set = v, true
+	}
+	return s, s.Value()
+}
+
+// Variance and standard deviation
+// Both use the same state, updated with Welford's algorithm. The variance is the
+// population variance.
+
+type MomentsState struct {
+	N    int64
+	Mean float64
+	M2   float64
+}
+
+func (s *MomentsState) add(v float64) {
+	s.N++
+	delta := v - s.Mean
+	s.Mean += delta / float64(s.N)
+	s.M2 += delta * (v - s.Mean)
+}
+
+func (s *MomentsState) Merge(other MergeableState) error {
+	o, ok := other.(*MomentsState)
+	if !ok {
+		return mergeError(s, other)
+	}
+	if o.N == 0 {
+		return nil
+	}
+	n := s.N + o.N
+	delta := o.Mean - s.Mean
+	s.M2 += o.M2 + delta*delta*float64(s.N)*float64(o.N)/float64(n)
+	s.Mean += delta * float64(o.N) / float64(n)
+	s.N = n
+	return nil
+}
+
+func (s *MomentsState) Variance() float64 {
+	if s.N == 0 {
+		return 0
+	}
+	return s.M2 / float64(s.N)
+}
+
+func (s *MomentsState) StdDev() float64 {
+	return math.Sqrt(s.Variance())
+}
+
+func (s *MomentsState) Value() interface{} {
+	return s.Variance()
+}
+
+func AggregatorVariance(accum, x interface{}) (accum2, x2 interface{}) {
+	s, ok := accum.(*MomentsState)
+	if !ok {
+		s = &MomentsState{}
+	}
+	if v, ok := toFloat64(x); ok {
+		s.add(v)
+	}
+	return s, s.Variance()
+}
+
+func AggregatorStdDev(accum, x interface{}) (accum2, x2 interface{}) {
+	s, ok := accum.(*MomentsState)
+	if !ok {
+		s = &MomentsState{}
+	}
+	if v, ok := toFloat64(x); ok {
+		s.add(v)
+	}
+	return s, s.StdDev()
+}
+
+// Exponentially weighted moving average
+// The half-life is measured in number of values: a value weighs half as much
+// as one aggregated HalfLife values after it. The average is normalized by the
+// total weight, so it is not biased towards zero while it warms up.
+
+type EWMAState struct {
+	HalfLife float64
+	Sum      float64
+	Weight   float64
+}
+
+func (s *EWMAState) Merge(other MergeableState) error {
+	o, ok := other.(*EWMAState)
+	if !ok || o.HalfLife != s.HalfLife {
+		return mergeError(s, other)
+	}
+	s.Sum += o.Sum
+	s.Weight += o.Weight
+	return nil
+}
+
+func (s *EWMAState) Value() interface{} {
+	if s.Weight == 0 {
+		return float64(0)
+	}
+	return s.Sum / s.Weight
+}
+
+func NewAggregatorEWMA(halfLife float64) func(accum, x interface{}) (accum2, x2 interface{}) {
+	if halfLife <= 0 {
+		panic("The half-life of an EWMA must be positive")
+	}
+	decay := math.Pow(0.5, 1/halfLife)
+
+	return func(accum, x interface{}) (accum2, x2 interface{}) {
+		s, ok := accum.(*EWMAState)
+		if !ok {
+			s = &EWMAState{HalfLife: halfLife}
+		}
+		if v, ok := toFloat64(x); ok {
+			s.Sum = s.Sum*decay + v
+			s.Weight = s.Weight*decay + 1
+		}
+		return s, s.Value()
+	}
+}
+
+// Approximate quantiles
+// Values are counted in logarithmically sized buckets, as HDR histograms do, so the
+// estimated quantiles have a bounded relative error while the state stays small.
+// Merging states only adds up their bucket counts, so it is exact.
+
+const DefaultQuantileAccuracy = 0.01
+
+type QuantileState struct {
+	Q        float64
+	Accuracy float64
+	Count    uint64
+	Zeros    uint64
+	Positive map[int]uint64
+	Negative map[int]uint64
+}
+
+func newQuantileState(q, accuracy float64) *QuantileState {
+	return &QuantileState{
+		Q:        q,
+		Accuracy: accuracy,
+		Positive: make(map[int]uint64),
+		Negative: make(map[int]uint64),
+	}
+}
+
+func (s *QuantileState) gamma() float64 {
+	return (1 + s.Accuracy) / (1 - s.Accuracy)
+}
+
+func (s *QuantileState) add(v float64) {
+	s.Count++
+	switch {
+	case v > 0:
+		s.Positive[int(math.Ceil(math.Log(v)/math.Log(s.gamma())))]++
+	case v < 0:
+		s.Negative[int(math.Ceil(math.Log(-v)/math.Log(s.gamma())))]++
+	default:
+		s.Zeros++
+	}
+}
+
+func (s *QuantileState) Merge(other MergeableState) error {
+	o, ok := other.(*QuantileState)
+	if !ok || o.Accuracy != s.Accuracy {
+		return mergeError(s, other)
+	}
+	s.Count += o.Count
+	s.Zeros += o.Zeros
+	for i, c := range o.Positive {
+		s.Positive[i] += c
+	}
+	for i, c := range o.Negative {
+		s.Negative[i] += c
+	}
+	return nil
+}
+
+// Quantile estimates the value below which lies the fraction q of the values
+func (s *QuantileState) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(s.Count-1))
+	gamma := s.gamma()
+	// Representative value of a bucket, within the accuracy of both its bounds
+	value := func(i int) float64 {
+		return 2 * math.Pow(gamma, float64(i)) / (gamma + 1)
+	}
+
+	var seen uint64
+	negatives := make([]int, 0, len(s.Negative))
+	for i := range s.Negative {
+		negatives = append(negatives, i)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(negatives)))
+	for _, i := range negatives {
+		if seen += s.Negative[i]; seen > rank {
+			return -value(i)
+		}
+	}
+	if seen += s.Zeros; seen > rank {
+		return 0
+	}
+	positives := make([]int, 0, len(s.Positive))
+	for i := range s.Positive {
+		positives = append(positives, i)
+	}
+	sort.Ints(positives)
+	for _, i := range positives {
+		if seen += s.Positive[i]; seen > rank {
+			return value(i)
+		}
+	}
+	return value(positives[len(positives)-1])
+}
+
+func (s *QuantileState) Value() interface{} {
+	return s.Quantile(s.Q)
+}
+
+// NewAggregatorQuantile aggregates the q quantile (i.e. 0.5 for the median, 0.99
+// for the 99th percentile) within DefaultQuantileAccuracy relative error
+func NewAggregatorQuantile(q float64) func(accum, x interface{}) (accum2, x2 interface{}) {
+	if q < 0 || q > 1 {
+		panic("Quantiles must be between 0 and 1")
+	}
+
+	return func(accum, x interface{}) (accum2, x2 interface{}) {
+		s, ok := accum.(*QuantileState)
+		if !ok {
+			s = newQuantileState(q, DefaultQuantileAccuracy)
+		}
+		if v, ok := toFloat64(x); ok {
+			s.add(v)
+		}
+		return s, s.Value()
+	}
+}
+
+// Approximate distinct count
+// A HyperLogLog sketch with 2^12 registers, which has a standard error of about
+// 1.6%. Values of any type are counted by their textual representation.
+
+const distinctPrecision = 12
+
+type DistinctState struct {
+	Registers []uint8
+}
+
+func (s *DistinctState) add(x interface{}) {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%T:%v", x, x)
+	hash := mix64(h.Sum64())
+
+	idx := hash >> (64 - distinctPrecision)
+	rank := uint8(bits.LeadingZeros64(hash<<distinctPrecision|1<<(distinctPrecision-1))) + 1
+	if rank > s.Registers[idx] {
+		s.Registers[idx] = rank
+	}
+}
+
+func (s *DistinctState) Merge(other MergeableState) error {
+	o, ok := other.(*DistinctState)
+	if !ok || len(o.Registers) != len(s.Registers) {
+		return mergeError(s, other)
+	}
+	for i, r := range o.Registers {
+		if r > s.Registers[i] {
+			s.Registers[i] = r
+		}
+	}
+	return nil
+}
+
+func (s *DistinctState) Estimate() int64 {
+	m := float64(len(s.Registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range s.Registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+
+	// Linear counting is more accurate for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+func (s *DistinctState) Value() interface{} {
+	return s.Estimate()
+}
+
+func AggregatorDistinctCount(accum, x interface{}) (accum2, x2 interface{}) {
+	s, ok := accum.(*DistinctState)
+	if !ok {
+		s = &DistinctState{Registers: make([]uint8, 1<<distinctPrecision)}
+	}
+	s.add(x)
+	return s, s.Value()
+}
+
+// Finalizer of splitmix64, to spread the bits of the FNV hash
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
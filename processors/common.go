@@ -11,3 +11,23 @@ type keyCountMap map[events.Key]int64
 var (
 	log = golog.LoggerFor("processors")
 )
+
+// copyEvent returns a copy of the event with its own Vals, with the extra ones added
+func copyEvent(evt *events.Event, extra events.Vals) *events.Event {
+	vals := make(events.Vals, len(evt.Vals)+len(extra))
+	for k, v := range evt.Vals {
+		vals[k] = v
+	}
+	for k, v := range extra {
+		vals[k] = v
+	}
+	c := *evt
+	c.Vals = vals
+	return &c
+}
+
+// A clock that can be replaced after being handed to others, i.e. to a KeyedState,
+// so they follow the clock a bolt gets from the pipeline
+type switchableClock struct {
+	events.Clock
+}
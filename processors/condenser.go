@@ -1,95 +1,202 @@
 // A condenser accumulates events until an event happens (timeout or max events)
 // Then it sends them in a burst, followed by a SystemEventMark event
+// Time limits are checked periodically with the pipeline clock, every
+// CheckInterval, so flushes can happen up to that long after they are due.
 
 package processors
 
 import (
-	"container/list"
 	"math"
 	"math/rand"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	events "github.com/getlantern/events-pipeline"
 )
 
+type DirectiveType int
+
 const (
-	KeepLast   = 1
-	KeepFirst  = 2
-	KeepRandom = 3
+	KeepLast   DirectiveType = 1
+	KeepFirst  DirectiveType = 2
+	KeepRandom DirectiveType = 3
+	// Keep the event with the highest (or lowest) numeric value in Field
+	KeepMax DirectiveType = 4
+	KeepMin DirectiveType = 5
+	// Keep one event with the Vals of all of them, later ones overwriting earlier ones
+	MergeVals DirectiveType = 6
+	// Keep the last event, with the number of events seen in Field
+	CountOccurrences DirectiveType = 7
+	// Keep the first and the last events, the last one with the time elapsed
+	// between them in Field
+	KeepFirstAndLast DirectiveType = 8
+	// Keep whatever the Reducer returns
+	Reduce DirectiveType = 9
+	// Keep a uniform random sample of up to SampleSize events, each with the number
+	// of events seen in Field. With a WeightField, the chance of an event being
+	// sampled is proportional to that value, events without a positive weight
+	// are never sampled, and the sampled events carry the sum of the weights seen
+	// in CondenserWeightTotalVal, so each of them stands for that sum divided by
+	// the size of the sample.
+	KeepSample DirectiveType = 10
 )
 
-type DirectiveType int
+// Fields written by the directives, all but the weight total by default
+const (
+	CondenserCountVal       = "count"
+	CondenserDurationVal    = "duration"
+	CondenserWeightTotalVal = "weight_total"
+)
+
+// Vals of the SystemEventMark sent after each flush, with the number of events
+// dropped and spilled to disk since the previous one
+const (
+	CondenserDroppedVal = "dropped"
+	CondenserSpilledVal = "spilled"
+)
+
+// A ReducerFunc combines the event kept so far (nil for the first event of the
+// period) with a new one, and returns the event to keep. It must not modify the
+// Vals of the events it gets, as they may be shared with other bolts.
+type ReducerFunc func(kept, evt *events.Event) *events.Event
 
 type CondenserDirective struct {
-	Key   events.Key
-	dtype DirectiveType
+	Key  events.Key
+	Type DirectiveType
+	// Field read or written by the directive, see the directive types
+	Field   string
+	Reducer ReducerFunc
+
+	SampleSize  int
+	WeightField string
 }
 
 type CondenserOptions struct {
-	Timeout   time.Duration
+	// Flush periodically
+	Timeout time.Duration
+	// Flush when no event has been received for this long
+	IdleTimeout time.Duration
+	// Flush when the oldest event buffered has been waiting for this long
+	MaxAge    time.Duration
 	MaxEvents uint64
+
+	// Limits of the buffer of events without directive: their estimated encoded
+	// size, and how many of them can be of the same key. Zero means no limit.
+	MaxBytes       uint64
+	MaxPerKey      int
+	OverflowPolicy OverflowPolicy
+	// File used by the SpillToDisk policy
+	SpillPath string
+
+	// How often the time limits are checked. Defaults to the shortest of them.
+	CheckInterval time.Duration
+	// Defaults to the pipeline clock
+	Clock events.Clock
+}
+
+// What is kept of the events of a key with a directive
+type condensed struct {
+	first *events.Event
+	kept  *events.Event
+	count int64
+
+	sample []*events.Event
+	// Keys of the weighted sample, the event with the lowest one is the first to go
+	sampleKeys  []float64
+	weightTotal float64
 }
 
 type directiveMap map[events.Key]CondenserDirective
-type filteredMap map[events.Key]*events.Event
+type filteredMap map[events.Key]*condensed
 
 type Condenser struct {
 	*events.ProcessorBase
 	directives directiveMap
 	filtered   filteredMap
-	unfiltered *list.List
+	unfiltered *eventBuffer
 	options    *CondenserOptions
 
-	keyCount keyCountMap
-	r        *rand.Rand
+	r *rand.Rand
 
-	evMtx      sync.Mutex
-	forceFlush chan struct{}
-	numEvs     uint64
+	evMtx     sync.Mutex
+	numEvs    uint64
+	lastFlush time.Time
+	lastEvent time.Time
+	oldest    time.Time
+
+	clock   events.Clock
+	stop    chan struct{}
+	stopped sync.WaitGroup
 }
 
 func NewCondenser(id string, opts *CondenserOptions, ds ...CondenserDirective) *Condenser {
 	if opts.MaxEvents == 0 {
 		opts.MaxEvents = math.MaxUint64
 	}
+	if opts.OverflowPolicy == SpillToDisk && opts.SpillPath == "" {
+		panic("CondenserOptions MUST include SpillPath to spill to disk")
+	}
 
 	dsmap := make(directiveMap)
 	for _, d := range ds {
+		switch d.Type {
+		case KeepMax, KeepMin:
+			if d.Field == "" {
+				panic("KeepMax and KeepMin directives need a Field")
+			}
+		case CountOccurrences:
+			if d.Field == "" {
+				d.Field = CondenserCountVal
+			}
+		case KeepSample:
+			if d.Field == "" {
+				d.Field = CondenserCountVal
+			}
+			if d.SampleSize <= 0 {
+				d.SampleSize = 1
+			}
+		case KeepFirstAndLast:
+			if d.Field == "" {
+				d.Field = CondenserDurationVal
+			}
+		case Reduce:
+			if d.Reducer == nil {
+				panic("Reduce directives need a Reducer")
+			}
+		case KeepLast, KeepFirst, KeepRandom, MergeVals:
+		default:
+			panic("Unknown condenser directive type")
+		}
 		dsmap[d.Key] = d
 	}
 
-	s := &Condenser{
+	if opts.CheckInterval == 0 {
+		for _, d := range []time.Duration{opts.Timeout, opts.IdleTimeout, opts.MaxAge} {
+			if d != 0 && (opts.CheckInterval == 0 || d < opts.CheckInterval) {
+				opts.CheckInterval = d
+			}
+		}
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = events.SystemClock
+	}
+
+	return &Condenser{
 		ProcessorBase: events.NewProcessorBase(id, nil),
 		directives:    dsmap,
 		filtered:      make(filteredMap),
-		unfiltered:    list.New(),
+		unfiltered:    newEventBuffer(opts),
 		options:       opts,
-		keyCount:      make(keyCountMap),
 		r:             rand.New(rand.NewSource(time.Now().UnixNano())),
-		forceFlush:    make(chan struct{}),
+		clock:         clock,
 	}
+}
 
-	go func() {
-		// TODO: handle stop and restart (need to stop ticker)
-		var ticker *time.Ticker
-		if opts.Timeout != 0 {
-			ticker = time.NewTicker(time.Second * opts.Timeout)
-		} else {
-			ticker = time.NewTicker(math.MaxInt64)
-		}
-
-		for {
-			select {
-			case <-ticker.C:
-			case <-s.forceFlush:
-				s.flush()
-			}
-		}
-	}()
-
-	return s
+func (s *Condenser) SetClock(c events.Clock) {
+	if s.options.Clock == nil {
+		s.clock = c
+	}
 }
 
 func (s *Condenser) Receive(evt *events.Event) error {
@@ -97,8 +204,15 @@ func (s *Condenser) Receive(evt *events.Event) error {
 
 	// Handle the SystemEvent signals
 	if evt.Key == "" {
-		if _, ok := evt.Vals[string(events.SystemEventStop)]; ok {
-			s.forceFlush <- struct{}{}
+		if _, ok := evt.Vals[string(events.SystemEventInit)]; ok {
+			s.start()
+		} else if _, ok := evt.Vals[string(events.SystemEventStop)]; ok {
+			if s.stop != nil {
+				close(s.stop)
+				s.stopped.Wait()
+				s.stop = nil
+			}
+			s.flush()
 		}
 		return nil
 	}
@@ -109,59 +223,223 @@ func (s *Condenser) Receive(evt *events.Event) error {
 	}
 
 	s.evMtx.Lock()
-	if d, ok := s.directives[evt.Key]; ok {
-		switch d.dtype {
-		case KeepLast:
-			s.filtered[evt.Key] = evt
-		case KeepFirst:
-			if _, ok := s.filtered[evt.Key]; !ok {
-				s.filtered[evt.Key] = evt
-			}
-		case KeepRandom:
-			numEvs, ok := s.keyCount[evt.Key]
-			if !ok {
-				s.keyCount[evt.Key] = 0
-				numEvs = 0
-			}
-			if s.r.Int63n(numEvs+1) == numEvs {
-				s.filtered[evt.Key] = evt
-			}
-			s.keyCount[evt.Key] = numEvs + 1
+	d, condense := s.directives[evt.Key]
+	var size uint64
+	if !condense {
+		size = s.unfiltered.sizeOf(evt)
+		if s.options.OverflowPolicy == FlushEarly && s.unfiltered.overflows(evt.Key, size) {
+			s.evMtx.Unlock()
+			s.flush()
+			s.evMtx.Lock()
 		}
-	} else {
-		s.unfiltered.PushBack(evt)
+	}
+
+	now := s.clock.Now()
+	if s.numEvs == 0 {
+		s.oldest = now
+	}
+	s.lastEvent = now
+	s.numEvs++
+	full := s.numEvs >= s.options.MaxEvents
+
+	if condense {
+		c, ok := s.filtered[evt.Key]
+		if !ok {
+			c = &condensed{first: evt}
+			s.filtered[evt.Key] = c
+		}
+		c.count++
+		s.condense(d, c, evt)
+	} else if err := s.unfiltered.add(evt, size); err != nil {
+		log.Errorf("Error buffering event: %v", err)
 	}
 	s.evMtx.Unlock()
 
-	if atomic.AddUint64(&s.numEvs, 1) >= s.options.MaxEvents {
-		s.forceFlush <- struct{}{}
+	if full {
+		s.flush()
 	}
 
 	return nil
 }
 
+// Must be called with the lock held
+func (s *Condenser) condense(d CondenserDirective, c *condensed, evt *events.Event) {
+	switch d.Type {
+	case KeepLast, CountOccurrences, KeepFirstAndLast:
+		c.kept = evt
+	case KeepFirst:
+		if c.kept == nil {
+			c.kept = evt
+		}
+	case KeepRandom:
+		// Single slot reservoir sampling
+		if s.r.Int63n(c.count) == c.count-1 {
+			c.kept = evt
+		}
+	case KeepMax, KeepMin:
+		v, ok := toFloat64(evt.Vals[d.Field])
+		if c.kept == nil {
+			c.kept = evt
+			return
+		}
+		kv, kok := toFloat64(c.kept.Vals[d.Field])
+		if ok && (!kok || (d.Type == KeepMax && v > kv) || (d.Type == KeepMin && v < kv)) {
+			c.kept = evt
+		}
+	case MergeVals:
+		if c.kept == nil {
+			c.kept = copyEvent(evt, nil)
+			return
+		}
+		for k, v := range evt.Vals {
+			c.kept.Vals[k] = v
+		}
+		c.kept.Timestamp = evt.Timestamp
+	case Reduce:
+		c.kept = d.Reducer(c.kept, evt)
+	case KeepSample:
+		if d.WeightField != "" {
+			s.sampleWeighted(d, c, evt)
+			return
+		}
+		// Algorithm R
+		if len(c.sample) < d.SampleSize {
+			c.sample = append(c.sample, evt)
+		} else if j := s.r.Int63n(c.count); j < int64(d.SampleSize) {
+			c.sample[j] = evt
+		}
+	}
+}
+
+// Weighted reservoir sampling (A-Res): every event gets the key u^(1/w), with u
+// uniformly random in [0, 1), and the events with the highest keys are kept
+func (s *Condenser) sampleWeighted(d CondenserDirective, c *condensed, evt *events.Event) {
+	w, ok := toFloat64(evt.Vals[d.WeightField])
+	if !ok || w <= 0 {
+		return
+	}
+	c.weightTotal += w
+	key := math.Pow(s.r.Float64(), 1/w)
+
+	if len(c.sample) < d.SampleSize {
+		c.sample = append(c.sample, evt)
+		c.sampleKeys = append(c.sampleKeys, key)
+		return
+	}
+	lowest := 0
+	for i, k := range c.sampleKeys {
+		if k < c.sampleKeys[lowest] {
+			lowest = i
+		}
+	}
+	if key > c.sampleKeys[lowest] {
+		c.sample[lowest] = evt
+		c.sampleKeys[lowest] = key
+	}
+}
+
+// condensedEvents returns the events to send for a key when flushing
+func (s *Condenser) condensedEvents(d CondenserDirective, c *condensed) []*events.Event {
+	switch d.Type {
+	case CountOccurrences:
+		return []*events.Event{copyEvent(c.kept, events.Vals{d.Field: c.count})}
+	case KeepFirstAndLast:
+		if c.count == 1 {
+			return []*events.Event{copyEvent(c.first, events.Vals{d.Field: time.Duration(0)})}
+		}
+		return []*events.Event{
+			c.first,
+			copyEvent(c.kept, events.Vals{d.Field: c.kept.Timestamp.Sub(c.first.Timestamp)}),
+		}
+	case KeepSample:
+		sample := make([]*events.Event, len(c.sample))
+		for i, evt := range c.sample {
+			vals := events.Vals{d.Field: c.count}
+			if d.WeightField != "" {
+				vals[CondenserWeightTotalVal] = c.weightTotal
+			}
+			sample[i] = copyEvent(evt, vals)
+		}
+		return sample
+	}
+	if c.kept == nil {
+		return nil
+	}
+	return []*events.Event{c.kept}
+}
+
+func (s *Condenser) start() {
+	if s.options.CheckInterval == 0 || s.stop != nil {
+		return
+	}
+
+	s.evMtx.Lock()
+	s.lastFlush = s.clock.Now()
+	s.evMtx.Unlock()
+
+	s.stop = make(chan struct{})
+	s.stopped.Add(1)
+	go func(stop chan struct{}) {
+		defer s.stopped.Done()
+
+		ticker := s.clock.NewTicker(s.options.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.Chan():
+				if s.due() {
+					s.flush()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(s.stop)
+}
+
+// due tells whether any of the time limits has been reached
+func (s *Condenser) due() bool {
+	s.evMtx.Lock()
+	defer s.evMtx.Unlock()
+
+	if s.numEvs == 0 {
+		return false
+	}
+	now := s.clock.Now()
+	return (s.options.Timeout != 0 && now.Sub(s.lastFlush) >= s.options.Timeout) ||
+		(s.options.IdleTimeout != 0 && now.Sub(s.lastEvent) >= s.options.IdleTimeout) ||
+		(s.options.MaxAge != 0 && now.Sub(s.oldest) >= s.options.MaxAge)
+}
+
 func (s *Condenser) flush() {
 	s.evMtx.Lock()
-	for el := s.unfiltered.Front(); el != nil; el = el.Next() {
-		err := s.ProcessorBase.Send(el.Value.(*events.Event))
+	unfiltered, dropped, spilled := s.unfiltered.drain()
+	for _, evt := range unfiltered {
+		err := s.ProcessorBase.Send(evt)
 		if err != nil {
 			log.Errorf("Error sending event")
 		}
 	}
-	s.unfiltered = list.New()
 
-	for _, v := range s.filtered {
-		err := s.ProcessorBase.Send(v)
-		if err != nil {
-			log.Errorf("Error sending event")
+	for k, c := range s.filtered {
+		for _, v := range s.condensedEvents(s.directives[k], c) {
+			err := s.ProcessorBase.Send(v)
+			if err != nil {
+				log.Errorf("Error sending event")
+			}
 		}
 	}
 	s.filtered = make(filteredMap)
-	s.keyCount = make(keyCountMap)
+	s.numEvs = 0
+	s.lastFlush = s.clock.Now()
 	s.evMtx.Unlock()
 
 	// Send a SystemEventMark
-	err := s.ProcessorBase.Send(events.NewEvent("", &events.Vals{string(events.SystemEventMark): nil}))
+	err := s.ProcessorBase.Send(events.NewEvent("", &events.Vals{
+		string(events.SystemEventMark): nil,
+		CondenserDroppedVal:            dropped,
+		CondenserSpilledVal:            spilled,
+	}))
 	if err != nil {
 		log.Errorf("Error sending event")
 	}
@@ -0,0 +1,201 @@
+// The buffer of the condenser events without directive, which is where its memory
+// goes (condensed keys keep a bounded number of events). The buffer can be limited
+// in size, estimated from the gob encoding of the events, and in number of events
+// per key. What happens when a limit is reached depends on the OverflowPolicy.
+
+package processors
+
+import (
+	"container/list"
+	"encoding/gob"
+	"io"
+	"os"
+
+	events "github.com/getlantern/events-pipeline"
+)
+
+type OverflowPolicy int
+
+const (
+	// Flush everything buffered so far
+	FlushEarly OverflowPolicy = iota
+	// Drop the oldest events buffered (of the same key, for the per key limit)
+	DropOldest
+	// Drop the event that doesn't fit
+	DropNewest
+	// Move everything buffered to a file, to be sent on the next flush
+	SpillToDisk
+)
+
+type bufferedEvent struct {
+	evt  *events.Event
+	size uint64
+}
+
+type eventBuffer struct {
+	options *CondenserOptions
+
+	events *list.List
+	perKey map[events.Key][]*list.Element
+	bytes  uint64
+
+	// Encodes the events only to learn their size. Types are sent once per
+	// stream, so after the first event the sizes are those of the values alone.
+	sizes   countingWriter
+	sizeEnc *gob.Encoder
+
+	spillFile *os.File
+	spillEnc  *gob.Encoder
+
+	dropped uint64
+	spilled uint64
+}
+
+func newEventBuffer(opts *CondenserOptions) *eventBuffer {
+	b := &eventBuffer{
+		options: opts,
+		events:  list.New(),
+		perKey:  make(map[events.Key][]*list.Element),
+	}
+	b.sizeEnc = gob.NewEncoder(&b.sizes)
+	return b
+}
+
+func (b *eventBuffer) sizeOf(evt *events.Event) uint64 {
+	if b.options.MaxBytes == 0 {
+		return 0
+	}
+	before := b.sizes
+	if err := b.sizeEnc.Encode(evt); err != nil {
+		return estimateValueSize(evt)
+	}
+	return uint64(b.sizes - before)
+}
+
+// overflows tells whether adding the event would go over any of the limits. A
+// single event is always allowed, whatever its size.
+func (b *eventBuffer) overflows(k events.Key, size uint64) bool {
+	return (b.options.MaxPerKey > 0 && len(b.perKey[k]) >= b.options.MaxPerKey) ||
+		(b.options.MaxBytes > 0 && b.bytes > 0 && b.bytes+size > b.options.MaxBytes)
+}
+
+func (b *eventBuffer) add(evt *events.Event, size uint64) error {
+	if b.overflows(evt.Key, size) {
+		switch b.options.OverflowPolicy {
+		case DropNewest:
+			b.dropped++
+			return nil
+		case DropOldest:
+			if b.options.MaxPerKey > 0 && len(b.perKey[evt.Key]) >= b.options.MaxPerKey {
+				b.remove(b.perKey[evt.Key][0])
+				b.dropped++
+			}
+			for b.options.MaxBytes > 0 && b.bytes > 0 && b.bytes+size > b.options.MaxBytes {
+				b.remove(b.events.Front())
+				b.dropped++
+			}
+		case SpillToDisk:
+			if err := b.spill(); err != nil {
+				b.dropped++
+				return err
+			}
+		}
+	}
+
+	el := b.events.PushBack(&bufferedEvent{evt: evt, size: size})
+	b.perKey[evt.Key] = append(b.perKey[evt.Key], el)
+	b.bytes += size
+	return nil
+}
+
+func (b *eventBuffer) remove(el *list.Element) {
+	be := b.events.Remove(el).(*bufferedEvent)
+	b.bytes -= be.size
+
+	els := b.perKey[be.evt.Key]
+	for i, e := range els {
+		if e == el {
+			els = append(els[:i], els[i+1:]...)
+			break
+		}
+	}
+	if len(els) == 0 {
+		delete(b.perKey, be.evt.Key)
+	} else {
+		b.perKey[be.evt.Key] = els
+	}
+}
+
+// spill moves all the events in memory to the spill file
+func (b *eventBuffer) spill() error {
+	if b.spillFile == nil {
+		f, err := os.OpenFile(b.options.SpillPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return err
+		}
+		b.spillFile = f
+		b.spillEnc = gob.NewEncoder(f)
+	}
+
+	for el := b.events.Front(); el != nil; el = el.Next() {
+		if err := b.spillEnc.Encode(el.Value.(*bufferedEvent).evt); err != nil {
+			log.Errorf("Error spilling event to disk: %v", err)
+			b.dropped++
+			continue
+		}
+		b.spilled++
+	}
+	b.events = list.New()
+	b.perKey = make(map[events.Key][]*list.Element)
+	b.bytes = 0
+	return nil
+}
+
+// drain empties the buffer, returning the events in it (first the spilled ones,
+// which are older) and how many were dropped and spilled since the last time
+func (b *eventBuffer) drain() (evs []*events.Event, dropped, spilled uint64) {
+	if b.spillFile != nil {
+		evs = b.readSpilled()
+	}
+	for el := b.events.Front(); el != nil; el = el.Next() {
+		evs = append(evs, el.Value.(*bufferedEvent).evt)
+	}
+	dropped, spilled = b.dropped, b.spilled
+
+	b.events = list.New()
+	b.perKey = make(map[events.Key][]*list.Element)
+	b.bytes = 0
+	b.dropped = 0
+	b.spilled = 0
+	return
+}
+
+func (b *eventBuffer) readSpilled() []*events.Event {
+	defer func() {
+		b.spillFile.Close()
+		os.Remove(b.options.SpillPath)
+		b.spillFile = nil
+		b.spillEnc = nil
+	}()
+
+	var evs []*events.Event
+	if _, err := b.spillFile.Seek(0, io.SeekStart); err != nil {
+		log.Errorf("Error reading spilled events: %v", err)
+		b.dropped += b.spilled
+		return nil
+	}
+	d := gob.NewDecoder(b.spillFile)
+	for {
+		evt := new(events.Event)
+		err := d.Decode(evt)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Errorf("Error reading spilled events: %v", err)
+			b.dropped += b.spilled - uint64(len(evs))
+			break
+		}
+		evs = append(evs, evt)
+	}
+	return evs
+}
@@ -1,3 +1,8 @@
+// A key rate limiter lets through up to MaxPerInterval events of each key per
+// interval, and discards the rest. Optionally, at the end of every interval it
+// sends one summary event per key with discarded events, with how many there
+// were and the timestamps of the first and the last of them.
+
 package processors
 
 import (
@@ -7,19 +12,46 @@ import (
 	events "github.com/getlantern/events-pipeline"
 )
 
+// Key suffix of the drop summary events
+const DropSummaryKeySuffix = ".dropped"
+
+// Vals of the drop summary events
+const (
+	DroppedCountVal = "dropped"
+	FirstDroppedVal = "first_dropped"
+	LastDroppedVal  = "last_dropped"
+)
+
 type KeyRateLimiterOptions struct {
 	Interval       time.Duration
 	MaxPerInterval int64
+
+	// Send a summary of the discarded events at the end of every interval
+	DropSummaries bool
+	// Derives the key of the drop summary events. Defaults to appending
+	// DropSummaryKeySuffix.
+	DropSummaryKey func(events.Key) events.Key
+	// Defaults to the pipeline clock
+	Clock events.Clock
+}
+
+type dropSummary struct {
+	count int64
+	first time.Time
+	last  time.Time
 }
 
 type KeyRateLimiter struct {
 	*events.ProcessorBase
 	options *KeyRateLimiterOptions
+	clock   events.Clock
+
+	sentKeyCount keyCountMap
+	dropped      map[events.Key]*dropSummary
+	keysMtx      sync.Mutex
 
-	sentKeyCount      keyCountMap
-	discardedKeyCount keyCountMap
-	keysMtx           sync.Mutex
-	ticker            *time.Ticker
+	stop    chan struct{}
+	stopped sync.WaitGroup
 }
 
 func NewKeyRateLimiter(id string, opts *KeyRateLimiterOptions) *KeyRateLimiter {
@@ -29,13 +61,29 @@ func NewKeyRateLimiter(id string, opts *KeyRateLimiterOptions) *KeyRateLimiter {
 	if opts.Interval == 0 {
 		opts.Interval = time.Minute
 	}
+	if opts.DropSummaryKey == nil {
+		opts.DropSummaryKey = func(k events.Key) events.Key {
+			return k + DropSummaryKeySuffix
+		}
+	}
+
+	clock := opts.Clock
+	if clock == nil {
+		clock = events.SystemClock
+	}
 
 	return &KeyRateLimiter{
-		ProcessorBase:     events.NewProcessorBase(id, nil),
-		options:           opts,
-		sentKeyCount:      make(keyCountMap),
-		discardedKeyCount: make(keyCountMap),
-		ticker:            time.NewTicker(opts.Interval),
+		ProcessorBase: events.NewProcessorBase(id, nil),
+		options:       opts,
+		clock:         clock,
+		sentKeyCount:  make(keyCountMap),
+		dropped:       make(map[events.Key]*dropSummary),
+	}
+}
+
+func (r *KeyRateLimiter) SetClock(c events.Clock) {
+	if r.options.Clock == nil {
+		r.clock = c
 	}
 }
 
@@ -44,6 +92,16 @@ func (r *KeyRateLimiter) Receive(evt *events.Event) error {
 
 	// Handle the SystemEvent signals
 	if evt.Key == "" {
+		if _, ok := evt.Vals[string(events.SystemEventInit)]; ok {
+			r.start()
+		} else if _, ok := evt.Vals[string(events.SystemEventStop)]; ok {
+			if r.stop != nil {
+				close(r.stop)
+				r.stopped.Wait()
+				r.stop = nil
+			}
+			r.endInterval()
+		}
 		return nil
 	}
 
@@ -53,34 +111,67 @@ func (r *KeyRateLimiter) Receive(evt *events.Event) error {
 	}
 
 	r.keysMtx.Lock()
-	defer r.keysMtx.Unlock()
+	if r.sentKeyCount[evt.Key] < r.options.MaxPerInterval {
+		r.sentKeyCount[evt.Key]++
+		r.keysMtx.Unlock()
+		return r.ProcessorBase.Send(evt)
+	}
 
-	select {
-	case <-r.ticker.C:
-		log.Tracef("Sent %v events during the last period", len(r.sentKeyCount))
-		log.Tracef("Discarded %v events during the last period", len(r.discardedKeyCount))
+	d, ok := r.dropped[evt.Key]
+	if !ok {
+		d = &dropSummary{first: evt.Timestamp}
+		r.dropped[evt.Key] = d
+	}
+	d.count++
+	d.last = evt.Timestamp
+	r.keysMtx.Unlock()
+	return nil
+}
 
-		r.sentKeyCount = make(keyCountMap)
-		r.discardedKeyCount = make(keyCountMap)
-		r.sentKeyCount[evt.Key] = 1
+func (r *KeyRateLimiter) start() {
+	if r.stop != nil {
+		return
+	}
 
-		return r.ProcessorBase.Send(evt)
-	default:
-		v, ok := r.sentKeyCount[evt.Key]
-		if !ok {
-			v = 0
-		}
+	r.stop = make(chan struct{})
+	r.stopped.Add(1)
+	go func(stop chan struct{}) {
+		defer r.stopped.Done()
 
-		if v < r.options.MaxPerInterval {
-			r.sentKeyCount[evt.Key] = v + 1
-			return r.ProcessorBase.Send(evt)
-		} else {
-			if vd, vok := r.discardedKeyCount[evt.Key]; vok {
-				r.discardedKeyCount[evt.Key] = vd + 1
-			} else {
-				r.discardedKeyCount[evt.Key] = 1
+		ticker := r.clock.NewTicker(r.options.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.Chan():
+				r.endInterval()
+			case <-stop:
+				return
 			}
-			return nil
+		}
+	}(r.stop)
+}
+
+// endInterval resets the counts and sends the drop summaries, if enabled
+func (r *KeyRateLimiter) endInterval() {
+	r.keysMtx.Lock()
+	log.Tracef("Sent events of %v keys during the last period", len(r.sentKeyCount))
+	log.Tracef("Discarded events of %v keys during the last period", len(r.dropped))
+	dropped := r.dropped
+	r.sentKeyCount = make(keyCountMap)
+	r.dropped = make(map[events.Key]*dropSummary)
+	r.keysMtx.Unlock()
+
+	if !r.options.DropSummaries {
+		return
+	}
+	for k, d := range dropped {
+		err := r.ProcessorBase.Send(events.NewEvent(r.options.DropSummaryKey(k), &events.Vals{
+			DroppedCountVal: d.count,
+			FirstDroppedVal: d.first,
+			LastDroppedVal:  d.last,
+		}))
+		if err != nil {
+			log.Errorf("Error sending event")
 		}
 	}
 }
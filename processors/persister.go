@@ -1,34 +1,147 @@
+// A persister writes every event it receives to a journal before sending it,
+// and records in the journal which ones have been acknowledged (delivered
+// without errors to all the receivers downstream) with commit records.
+// Commit records hold the sequence number up to which every event has been
+// acknowledged, so on start only the events after the last one are replayed.
+// Events that fail to be delivered are sent again every RetryInterval, and once
+// they have been failing for DeliveryDeadline they are given to DeadLetter and
+// acknowledged, so the commit point keeps moving. Events not acknowledged when
+// the process dies are replayed, with every event after them, on the next start.
+// The journal is split in segments, and the segments with only committed
+// events are deleted or archived, so recovery only reads the segments after
+// the last commit.
+// Replayed events carry an events.Replay, with when they were persisted, how
+// many times they have been replayed, counted with a replay record written on
+// every start, and where they are in the journal.
+// The disk taken by the journal can be limited, see persisterdisk.go.
+
 package processors
 
 import (
-	"bytes"
-	"encoding/gob"
-	"io"
 	"math"
 	"os"
+	"sort"
 	"sync"
-	"sync/atomic"
+	"time"
 
 	events "github.com/getlantern/events-pipeline"
+	"github.com/getlantern/events-pipeline/journal"
 )
 
 type PersisterOptions struct {
+	// A commit record is written once this many events have been acknowledged,
+	// or this many bytes journaled, since the last one, and on stop. Defaults to
+	// 100 events, so up to that many events already delivered are replayed
+	// after a crash. Set it to 1 to replay only the events not acknowledged, at
+	// the cost of a commit record for every event.
 	MaxBufferSize uint64
 	MaxEvents     uint32
-	PersistPath   string
+	// Directory of the journal segments
+	PersistPath string
+
+	// Limits of every segment. See journal.Options.
+	MaxSegmentSize int64
+	MaxSegmentAge  time.Duration
+	// What to do with the segments once all their events are committed
+	Retention journal.RetentionPolicy
+	// Where the segments are archived, and how many are kept there
+	ArchivePath string
+	MaxArchived int
+
+	// When the journal is synced to disk. See journal.SyncPolicy.
+	Sync         journal.SyncPolicy
+	SyncInterval time.Duration
+	SyncEvents   int
+
+	// Compresses the journal in batches of records, journal.Gzip or a registered
+	// codec. See journal.Options.
+	Codec        journal.Codec
+	BatchRecords int
+
+	// Encrypts the journal. A journal that can't be read, because a record fails
+	// the authentication or a key is unknown, isn't replayed nor written to.
+	Keys journal.KeyProvider
+
+	// Bytes the journal segments can take, not counting the archived ones, which
+	// should be a few times MaxSegmentSize, and bytes that must be left free in
+	// the file system. Zero means no limit.
+	MaxDiskUsage int64
+	MinFreeSpace uint64
+	// What to do when a limit is hit
+	DiskPolicy DiskPolicy
+	// How often the free space is checked, and whether there's room again with
+	// ApplyBackpressure. Defaults to a second.
+	DiskCheckInterval time.Duration
+	// How long events wait for room with ApplyBackpressure. Defaults to 10
+	// seconds.
+	MaxBackpressure time.Duration
+
+	// Events per second replayed on start, so a large backlog doesn't flood the
+	// receivers. Zero means no limit.
+	ReplayRate float64
+
+	// How often failed deliveries are retried, and for how long. Defaults to a
+	// second and a minute.
+	RetryInterval    time.Duration
+	DeliveryDeadline time.Duration
+	// Gets the events given up on, which are acknowledged. They are only logged
+	// if not set.
+	DeadLetter func(evt *events.Event)
+	// Events waiting for their acknowledgement, counting the ones acknowledged
+	// after the oldest one. Past it the oldest ones are given up on. Defaults to
+	// 10000.
+	MaxPending int
+
+	Clock events.Clock
+}
+
+type pendingEvent struct {
+	seq        uint64
+	deliveries int
+	// Some delivery failed, the first time at failedAt
+	failed   bool
+	failedAt time.Time
+	retryAt  time.Time
 }
 
 type Persister struct {
 	*events.ProcessorBase
 	options *PersisterOptions
-
-	numEvents   uint32
-	journalFile *os.File
-	persistWg   sync.WaitGroup
-	b           *bytes.Buffer
-	bMtx        sync.RWMutex
-	e           *gob.Encoder
-	d           *gob.Decoder
+	clock   events.Clock
+
+	journal *journal.Journal
+	written uint64
+	// The last sequence number in every segment with events
+	segmentSeqs map[uint64]uint64
+
+	seq       uint64
+	acked     uint64
+	ackedSeqs map[uint64]bool
+	committed uint64
+	pending   map[*events.Event]*pendingEvent
+	// The pending events by sequence number
+	pendingSeqs map[uint64]*events.Event
+	// The events being appended, with the segment being written when they
+	// started
+	appending map[uint64]uint64
+
+	// Since the last commit record
+	numEvents       uint32
+	writtenAtCommit uint64
+
+	diskStatus    DiskStatus
+	freeSpace     uint64
+	freeCheckedAt time.Time
+	// The free space can't be checked on this system
+	noFreeSpace bool
+	// An event waited MaxBackpressure, and there's been no room since
+	waitedTooLong bool
+
+	mtx sync.Mutex
+	// Taken before mtx, so commit records are appended one at a time
+	commitMtx sync.Mutex
+	stop      chan struct{}
+	replayWg  sync.WaitGroup
 }
 
 func NewPersister(id string, opts *PersisterOptions) *Persister {
@@ -37,26 +150,59 @@ func NewPersister(id string, opts *PersisterOptions) *Persister {
 	}
 
 	if opts.MaxEvents == 0 {
-		opts.MaxEvents = math.MaxInt32
+		opts.MaxEvents = 100
 	}
 
 	if opts.PersistPath == "" {
 		panic("PersisterOptions MUST include PersistPath")
 	}
 
-	b := new(bytes.Buffer)
+	if opts.DiskCheckInterval == 0 {
+		opts.DiskCheckInterval = time.Second
+	}
+
+	if opts.MaxBackpressure == 0 {
+		opts.MaxBackpressure = 10 * time.Second
+	}
+
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = time.Second
+	}
+
+	if opts.DeliveryDeadline == 0 {
+		opts.DeliveryDeadline = time.Minute
+	}
+
+	if opts.MaxPending == 0 {
+		opts.MaxPending = 10000
+	}
+
+	clock := opts.Clock
+	if clock == nil {
+		clock = events.SystemClock
+	}
+
 	p := &Persister{
-		options: opts,
-		b:       b,
-		e:       gob.NewEncoder(b),
-		d:       gob.NewDecoder(b),
+		options:     opts,
+		clock:       clock,
+		segmentSeqs: make(map[uint64]uint64),
+		ackedSeqs:   make(map[uint64]bool),
+		pending:     make(map[*events.Event]*pendingEvent),
+		pendingSeqs: make(map[uint64]*events.Event),
+		appending:   make(map[uint64]uint64),
 	}
-	commitMarker := func(e *events.Event) error { p.markCommit(); return nil }
-	p.ProcessorBase = events.NewProcessorBase(id, commitMarker)
+	p.ProcessorBase = events.NewProcessorBase(id, p.ack)
+	p.SetErrorFeedback(p.ack)
 
 	return p
 }
 
+func (p *Persister) SetClock(c events.Clock) {
+	if p.options.Clock == nil {
+		p.clock = c
+	}
+}
+
 func (p *Persister) Receive(evt *events.Event) error {
 	log.Tracef("Persister ID %v processed event: %v with: %v", p.ID(), evt.Key, evt.Vals)
 
@@ -65,36 +211,40 @@ func (p *Persister) Receive(evt *events.Event) error {
 		if _, ok := evt.Vals[string(events.SystemEventInit)]; ok {
 			log.Debugf("Initializing Persister")
 
-			// First try to recover events is necessary
-			var err error
-			p.journalFile, err = os.OpenFile(p.options.PersistPath, os.O_RDONLY, 0666)
-			if err != nil {
-				if !os.IsNotExist(err) {
-					log.Errorf("Error opening events recovery file: %v", err)
-				}
-			} else {
-				recovered, errRvr := p.recoverEvents()
-				if errRvr != nil {
-					log.Errorf("Error processing recovery file: %v", err)
-				} else {
-					for _, ev := range recovered {
-						p.Receive(&ev)
-					}
-				}
-				p.journalFile.Close()
-			}
-
-			p.journalFile, err = os.OpenFile(
-				p.options.PersistPath,
-				os.O_APPEND|os.O_WRONLY|os.O_CREATE,
-				0666,
-			)
+			recovered, err := p.openJournal()
 			if err != nil {
 				log.Errorf("Error opening or creating event recovery file: %v", err)
 			}
+
+			// The wires aren't running yet, so the events can't be sent right away
+			p.mtx.Lock()
+			p.stop = make(chan struct{})
+			p.replayWg.Add(2)
+			go p.replay(recovered, p.stop)
+			go p.retry(p.stop)
+			p.mtx.Unlock()
 		} else if _, ok := evt.Vals[string(events.SystemEventStop)]; ok {
-			p.persistWg.Wait()
-			p.journalFile.Close()
+			p.mtx.Lock()
+			if p.stop != nil {
+				close(p.stop)
+				p.stop = nil
+			}
+			p.mtx.Unlock()
+			p.replayWg.Wait()
+
+			p.commitMtx.Lock()
+			p.mtx.Lock()
+			if err := p.markCommit(); err != nil {
+				log.Errorf("Error writing commit record: %v", err)
+			}
+			if p.journal != nil {
+				if err := p.journal.Close(); err != nil {
+					log.Errorf("Error closing journal: %v", err)
+				}
+				p.journal = nil
+			}
+			p.mtx.Unlock()
+			p.commitMtx.Unlock()
 		}
 		return nil
 	}
@@ -104,85 +254,533 @@ func (p *Persister) Receive(evt *events.Event) error {
 		return err
 	}
 
-	if err := p.persistEvent(evt); err != nil {
+	err = p.makeRoom()
+	if err == nil {
+		err = p.persistEvent(evt)
+	}
+	if err != nil {
 		log.Errorf("Error saving event to recovery file: %v", err)
+		evt = copyEvent(evt, events.Vals{PersisterNonDurableVal: true})
 	}
 
 	return p.ProcessorBase.Send(evt)
 }
 
-func (p *Persister) markCommit() {
-	// TODO
+// replay sends the recovered events, at most ReplayRate per second. The ones
+// left when stopping are replayed on the next start.
+func (p *Persister) replay(recovered []*events.Event, stop chan struct{}) {
+	defer p.replayWg.Done()
+
+	var tick <-chan time.Time
+	if p.options.ReplayRate > 0 && len(recovered) > 1 {
+		ticker := p.clock.NewTicker(time.Duration(float64(time.Second) / p.options.ReplayRate))
+		defer ticker.Stop()
+		tick = ticker.Chan()
+	}
+	for i, ev := range recovered {
+		if tick != nil && i > 0 {
+			select {
+			case <-tick:
+			case <-stop:
+				log.Debugf("Stopped replaying with %v events left", len(recovered)-i)
+				return
+			}
+		}
+		if err := p.ProcessorBase.Send(ev); err != nil {
+			log.Errorf("Error sending recovered event: %v", err)
+		}
+	}
+}
+
+// openJournal recovers the events not committed, which are journaled already,
+// and opens the journal to add more
+func (p *Persister) openJournal() ([]*events.Event, error) {
+	if err := p.migrateJournal(); err != nil {
+		return nil, err
+	}
+
+	// Failing closed, so nothing is replayed nor written after records that may
+	// have been altered
+	recovered, seqs, err := p.recoverJournal()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.journal, err = journal.Open(p.journalOptions(p.options.PersistPath))
+	if err != nil {
+		return recovered, err
+	}
+
+	// Counting this replay
+	if len(recovered) > 0 {
+		if _, err := p.append(&JournalRecord{Type: JournalReplay, Seq: seqs[len(seqs)-1]}); err != nil {
+			log.Errorf("Error writing replay record: %v", err)
+		}
+	}
+
+	// The recovered events are sent again, so they wait for their acknowledgement,
+	// unless nothing receives them. The records that couldn't be read have nothing
+	// to wait for.
+	deliveries := p.deliveries()
+	next := 0
+	for seq := p.committed + 1; seq <= p.seq; seq++ {
+		if next < len(seqs) && seqs[next] == seq && deliveries > 0 {
+			p.addPending(recovered[next], seq, deliveries)
+		} else {
+			p.ackedSeqs[seq] = true
+		}
+		if next < len(seqs) && seqs[next] == seq {
+			next++
+		}
+	}
+	for p.ackedSeqs[p.acked+1] {
+		delete(p.ackedSeqs, p.acked+1)
+		p.acked++
+	}
+	if err := p.markCommit(); err != nil {
+		log.Errorf("Error writing commit record: %v", err)
+	}
+	return recovered, nil
+}
+
+// journalOptions returns the options of the journal in the directory
+func (p *Persister) journalOptions(dir string) *journal.Options {
+	return &journal.Options{
+		Dir:            dir,
+		MaxSegmentSize: p.options.MaxSegmentSize,
+		MaxSegmentAge:  p.options.MaxSegmentAge,
+		Retention:      p.options.Retention,
+		ArchiveDir:     p.options.ArchivePath,
+		MaxArchived:    p.options.MaxArchived,
+		Sync:           p.options.Sync,
+		SyncInterval:   p.options.SyncInterval,
+		SyncEvents:     p.options.SyncEvents,
+		Codec:          p.options.Codec,
+		BatchRecords:   p.options.BatchRecords,
+		Keys:           p.options.Keys,
+	}
+}
+
+// addPending must be called with the lock held
+func (p *Persister) addPending(evt *events.Event, seq uint64, deliveries int) {
+	p.pending[evt] = &pendingEvent{seq: seq, deliveries: deliveries}
+	p.pendingSeqs[seq] = evt
+}
+
+// removePending must be called with the lock held
+func (p *Persister) removePending(evt *events.Event, pe *pendingEvent) {
+	delete(p.pending, evt)
+	delete(p.pendingSeqs, pe.seq)
+}
+
+func (p *Persister) deliveries() int {
+	n := 0
+	for _, w := range p.ProcessorBase.Outlets() {
+		n += w.NumReceivers()
+	}
+	return n
 }
 
 func (p *Persister) persistEvent(evt *events.Event) error {
-	p.persistWg.Add(1)
+	given, due, err := p.journalEvent(evt)
+	p.deadLetter(given, "too many events waiting for it")
+	if due {
+		if cerr := p.commit(); cerr != nil {
+			log.Errorf("Error writing commit record: %v", cerr)
+		}
+	}
+	return err
+}
+
+// journalEvent returns the events given up on to make room for it, and whether
+// a commit record is due. The event is appended without the lock, so the
+// events journaled at once share a sync, and may end up in the journal out of
+// order.
+func (p *Persister) journalEvent(evt *events.Event) ([]*events.Event, bool, error) {
+	p.mtx.Lock()
+	j := p.journal
+	if j == nil {
+		p.mtx.Unlock()
+		return nil, false, os.ErrClosed
+	}
+	p.seq++
+	seq := p.seq
+	deliveries := p.deliveries()
+	if deliveries > 0 {
+		p.addPending(evt, seq, deliveries)
+	}
+	segments := j.Segments()
+	p.appending[seq] = segments[len(segments)-1]
+	p.mtx.Unlock()
+
+	b, err := (&JournalRecord{Type: JournalEvent, Seq: seq, Event: evt, PersistedAt: p.clock.Now()}).Encode()
+	var pos journal.Position
+	if err == nil {
+		pos, err = j.Append(b)
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	delete(p.appending, seq)
+	if err != nil {
+		// Nothing waits for it
+		if pe, ok := p.pending[evt]; ok && pe.seq == seq {
+			p.removePending(evt, pe)
+		}
+		return nil, p.acknowledge(seq), err
+	}
+	p.written += uint64(len(b))
+	if seq > p.segmentSeqs[pos.Segment] {
+		p.segmentSeqs[pos.Segment] = seq
+	}
+	if deliveries == 0 {
+		return nil, p.acknowledge(seq), nil
+	}
+
+	// Too many events wait for the oldest one. One still being appended hasn't
+	// been sent yet, and is given up on, if need be, once appended.
+	var (
+		given []*events.Event
+		due   bool
+	)
+	for p.seq-p.acked > uint64(p.options.MaxPending) {
+		if _, ok := p.appending[p.acked+1]; ok {
+			break
+		}
+		evt, d := p.giveUp(p.acked + 1)
+		if evt != nil {
+			given = append(given, evt)
+		}
+		due = due || d
+	}
+	return given, due, nil
+}
 
-	p.bMtx.Lock()
-	err := p.e.Encode(evt)
+// append must be called with the lock held
+func (p *Persister) append(r *JournalRecord) (journal.Position, error) {
+	b, err := r.Encode()
 	if err != nil {
 		log.Errorf("Error encoding event to gob: %v", err)
+		return journal.Position{}, err
+	}
+	pos, err := p.journal.Append(b)
+	if err == nil {
+		p.written += uint64(len(b))
+	}
+	return pos, err
+}
+
+// ack is the feedback handler, called after every delivery of the events sent
+func (p *Persister) ack(evt *events.Event) error {
+	if p.delivered(evt) {
+		return p.commit()
+	}
+	return nil
+}
+
+// delivered counts a delivery, and tells whether a commit record is due
+func (p *Persister) delivered(evt *events.Event) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	pe, ok := p.pending[evt.Origin()]
+	if !ok {
+		return false
+	}
+	if evt.DeliveryError() != nil {
+		if pe.failedAt.IsZero() {
+			pe.failedAt = p.clock.Now()
+		}
+		pe.failed = true
+	}
+	pe.deliveries--
+	if pe.deliveries > 0 {
+		return false
+	}
+	if pe.failed {
+		// Sent again by retry
+		pe.retryAt = p.clock.Now().Add(p.options.RetryInterval)
+		return false
 	}
-	p.bMtx.Unlock()
+	p.removePending(evt.Origin(), pe)
+	return p.acknowledge(pe.seq)
+}
 
-	atomic.AddUint32(&p.numEvents, 1)
+// retry sends again the events that failed to be delivered, and gives up on
+// the ones past the DeliveryDeadline, until stopped
+func (p *Persister) retry(stop chan struct{}) {
+	defer p.replayWg.Done()
 
-	p.bMtx.RLock()
+	ticker := p.clock.NewTicker(p.options.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.Chan():
+		case <-stop:
+			return
+		}
 
-	//
-	// TODO:
-	// - write in chunks (which should be options)
-	// - rotating files
-	// Keeping sizes reasonable via rotation or similar
-	//
+		var (
+			seqs           []uint64
+			retries, given []*events.Event
+			due            bool
+		)
+		p.mtx.Lock()
+		now := p.clock.Now()
+		deliveries := p.deliveries()
+		for evt, pe := range p.pending {
+			if !pe.failed || pe.deliveries > 0 || now.Before(pe.retryAt) {
+				continue
+			}
+			if now.Sub(pe.failedAt) >= p.options.DeliveryDeadline {
+				_, d := p.giveUp(pe.seq)
+				due = due || d
+				given = append(given, evt)
+				continue
+			}
+			// Every receiver gets it again, the ones that took it too
+			pe.failed, pe.deliveries = false, deliveries
+			seqs = append(seqs, pe.seq)
+		}
+		// In the order they were sent
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+		for _, seq := range seqs {
+			retries = append(retries, p.pendingSeqs[seq])
+		}
+		p.mtx.Unlock()
+
+		p.deadLetter(given, "past the delivery deadline")
+		if due {
+			if err := p.commit(); err != nil {
+				log.Errorf("Error writing commit record: %v", err)
+			}
+		}
+		for _, evt := range retries {
+			if err := p.ProcessorBase.Send(evt); err != nil {
+				log.Errorf("Error sending event again: %v", err)
+			}
+		}
+	}
+}
+
+// giveUp acknowledges an event that won't be delivered, returning it if it was
+// pending, and whether a commit record is due. It must be called with the lock
+// held.
+func (p *Persister) giveUp(seq uint64) (*events.Event, bool) {
+	evt, ok := p.pendingSeqs[seq]
+	if ok {
+		p.removePending(evt, p.pending[evt])
+	}
+	return evt, p.acknowledge(seq)
+}
+
+func (p *Persister) deadLetter(given []*events.Event, reason string) {
+	for _, evt := range given {
+		if p.options.DeadLetter != nil {
+			p.options.DeadLetter(evt)
+		} else {
+			log.Errorf("Gave up delivering event %v, %v", evt.Key, reason)
+		}
+	}
+}
+
+// acknowledge moves forward the sequence number up to which all the events
+// have been delivered, and tells whether a commit record is due. It must be
+// called with the lock held.
+func (p *Persister) acknowledge(seq uint64) bool {
+	if seq <= p.acked || p.ackedSeqs[seq] {
+		return false
+	}
+	p.ackedSeqs[seq] = true
+	for p.ackedSeqs[p.acked+1] {
+		delete(p.ackedSeqs, p.acked+1)
+		p.acked++
+	}
+
+	p.numEvents++
+	return p.numEvents >= p.options.MaxEvents ||
+		p.written-p.writtenAtCommit >= p.options.MaxBufferSize
+}
+
+// commit writes a commit record, if anything has been acknowledged since the
+// last one, and releases the segments no longer needed. The record is appended
+// without the lock, so the events journaled and acknowledged meanwhile don't
+// wait for its sync, and a commit waiting for another may find its events
+// committed already.
+func (p *Persister) commit() error {
+	p.commitMtx.Lock()
+	defer p.commitMtx.Unlock()
+
+	p.mtx.Lock()
+	j, seq := p.journal, p.acked
+	if seq == p.committed || j == nil {
+		p.mtx.Unlock()
+		return nil
+	}
+	p.numEvents = 0
+	p.writtenAtCommit = p.written
+	p.mtx.Unlock()
+
+	b, err := (&JournalRecord{Type: JournalCommit, Seq: seq}).Encode()
+	if err == nil {
+		_, err = j.Append(b)
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
 
-	_, err = p.journalFile.Write(p.b.Bytes())
 	if err != nil {
-		p.bMtx.RUnlock()
 		return err
-
 	}
-	p.bMtx.RUnlock()
+	p.written += uint64(len(b))
+	p.committed = seq
+	return p.release()
+}
 
-	// We will force a commit mark if any of the limits is reached.  This ensures
-	// that in case of failure we don't end up recovering too many events on the next run
-	if p.numEvents >= p.options.MaxEvents || p.b.Len() >= int(p.options.MaxBufferSize) {
-		p.markCommit()
+// markCommit is commit with both locks held, for when nothing else uses the
+// journal
+func (p *Persister) markCommit() error {
+	if p.acked == p.committed || p.journal == nil {
+		return nil
 	}
-	p.persistWg.Done()
+	_, err := p.append(&JournalRecord{Type: JournalCommit, Seq: p.acked})
+	if err != nil {
+		return err
+	}
+	p.committed = p.acked
+	p.numEvents = 0
+	p.writtenAtCommit = p.written
+	return p.release()
+}
 
+// release releases the segments with only committed events. It must be called
+// with the lock held.
+func (p *Persister) release() error {
+	// Segments are released in order, and never the one being written, nor any
+	// an event being appended may be in
+	segments := p.journal.Segments()
+	// Events appended to a segment a torn frame ended may be in the next ones
+	for _, n := range segments {
+		if to, ok := p.journal.Carried(n); ok && p.segmentSeqs[n] > p.segmentSeqs[to] {
+			p.segmentSeqs[to] = p.segmentSeqs[n]
+		}
+	}
+	for _, n := range segments[:len(segments)-1] {
+		if p.segmentSeqs[n] > p.committed || !p.appendedBefore(n) {
+			break
+		}
+		if err := p.journal.Release(n); err != nil {
+			return err
+		}
+		delete(p.segmentSeqs, n)
+	}
 	return nil
 }
 
-func (p *Persister) recoverEvents() ([]events.Event, error) {
-	//
-	// TODO:
-	// Scan the recovery file for the latest commit mark and replay events from there
-	//
+// Sorts events by their sequence numbers
+type bySeq struct {
+	evts []*events.Event
+	seqs []uint64
+}
 
-	p.bMtx.Lock()
-	defer p.bMtx.Unlock()
+func (s bySeq) Len() int           { return len(s.seqs) }
+func (s bySeq) Less(i, j int) bool { return s.seqs[i] < s.seqs[j] }
+func (s bySeq) Swap(i, j int) {
+	s.evts[i], s.evts[j] = s.evts[j], s.evts[i]
+	s.seqs[i], s.seqs[j] = s.seqs[j], s.seqs[i]
+}
 
-	_, err := io.Copy(p.b, p.journalFile)
-	if err != nil {
-		return nil, err
+// appendedBefore tells whether no event being appended can be in the segment.
+// It must be called with the lock held.
+func (p *Persister) appendedBefore(n uint64) bool {
+	for _, current := range p.appending {
+		if n >= current {
+			return false
+		}
 	}
-	var recovered []events.Event
-	var evt events.Event
-	for {
-		err := p.d.Decode(&evt)
+	return true
+}
+
+// recoverEvents returns the events in the journal after the last commit record
+func (p *Persister) recoverEvents() ([]*events.Event, error) {
+	recovered, _, err := p.recoverJournal()
+	return recovered, err
+}
 
-		log.Tracef("Error in decoder: %v", err)
+// recoverJournal returns the events after the last commit record, with their
+// sequence numbers, and sets where the journal was left
+func (p *Persister) recoverJournal() ([]*events.Event, []uint64, error) {
+	var (
+		recovered []*events.Event
+		seqs      []uint64
+		seen      = make(map[uint64]bool)
+		// Up to where every previous replay went
+		replays []uint64
+	)
+	corrupted, err := journal.ScanDir(p.options.PersistPath, p.options.Keys, func(pos journal.Position, rec []byte) error {
+		r, err := DecodeJournalRecord(rec)
 		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return nil, err
+			log.Errorf("Error decoding journal record at %v, skipping it: %v", pos, err)
+			return nil
+		}
+
+		switch r.Type {
+		case JournalEvent:
+			// Left behind by a compaction that didn't finish
+			if seen[r.Seq] || r.Seq <= p.committed {
+				return nil
+			}
+			seen[r.Seq] = true
+			r.Event.Replay = &events.Replay{
+				PersistedAt: r.PersistedAt,
+				Segment:     pos.Segment,
+				Offset:      pos.Offset,
+				Index:       pos.Index,
 			}
+			recovered = append(recovered, r.Event)
+			seqs = append(seqs, r.Seq)
+			if r.Seq > p.segmentSeqs[pos.Segment] {
+				p.segmentSeqs[pos.Segment] = r.Seq
+			}
+		case JournalCommit:
+			// Events may be journaled out of order, but always before their commit
+			i := 0
+			for k, seq := range seqs {
+				if seq > r.Seq {
+					recovered[i], seqs[i] = recovered[k], seq
+					i++
+				}
+			}
+			recovered, seqs = recovered[:i], seqs[:i]
+			if r.Seq > p.committed {
+				p.committed = r.Seq
+			}
+		case JournalReplay:
+			replays = append(replays, r.Seq)
 		}
-		recovered = append(recovered, evt)
-	}
+		if r.Seq > p.seq {
+			p.seq = r.Seq
+		}
+		return nil
+	})
 
-	p.b.Reset()
-	return recovered, nil
+	for _, ce := range corrupted {
+		log.Errorf("Skipped data of the journal that couldn't be read: %v", ce)
+	}
+	sort.Sort(bySeq{recovered, seqs})
+	for i, ev := range recovered {
+		ev.Replay.Count = 1
+		for _, upTo := range replays {
+			if upTo >= seqs[i] {
+				ev.Replay.Count++
+			}
+		}
+	}
+	p.acked = p.committed
+	log.Debugf("Recovered %v events not committed", len(recovered))
+	return recovered, seqs, err
 }
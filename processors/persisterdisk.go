@@ -0,0 +1,226 @@
+// Limits to the disk taken by the Persister journal
+// Before journaling an event, the Persister checks the size of the journal and
+// the free space left, and applies the DiskPolicy while over a limit. Events
+// that can't be journaled, for this or any other reason, are still sent, tagged
+// with PersisterNonDurableVal. Every change of the disk status is sent
+// downstream as a SystemEventStatus. Once over a limit, there's room again
+// below 90% of MaxDiskUsage, or above 110% of MinFreeSpace, so the status
+// doesn't flap with every event.
+
+package processors
+
+import (
+	"fmt"
+	"time"
+
+	events "github.com/getlantern/events-pipeline"
+	"github.com/getlantern/events-pipeline/journal"
+)
+
+type DiskPolicy int
+
+const (
+	// Events are sent without being journaled
+	StopPersisting DiskPolicy = iota
+	// The oldest segments are deleted, even with events not acknowledged, which
+	// won't be replayed
+	EvictOldest
+	// Events wait until there's room, holding back the senders, for at most
+	// MaxBackpressure. Past it, events aren't journaled until there's room.
+	ApplyBackpressure
+)
+
+type DiskStatus int
+
+const (
+	DiskOK DiskStatus = iota
+	DiskQuotaExceeded
+	DiskLowSpace
+)
+
+func (s DiskStatus) String() string {
+	switch s {
+	case DiskOK:
+		return "ok"
+	case DiskQuotaExceeded:
+		return "quota_exceeded"
+	case DiskLowSpace:
+		return "low_space"
+	}
+	return "unknown"
+}
+
+const (
+	// Set to true on the events sent without being journaled
+	PersisterNonDurableVal = "non_durable"
+
+	// Vals of the SystemEventStatus sent when the disk status changes
+	PersisterIDVal         = "persister"
+	PersisterDiskStatusVal = "disk_status"
+	PersisterDiskUsageVal  = "disk_usage"
+	PersisterFreeSpaceVal  = "free_space"
+)
+
+// makeRoom returns once the journal is within its limits, or with an error if
+// the event can't be journaled
+func (p *Persister) makeRoom() error {
+	var ticker events.Ticker
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	var started time.Time
+	for {
+		p.mtx.Lock()
+		status, changed := p.checkDisk()
+		if status == DiskOK {
+			p.waitedTooLong = false
+		}
+		usage, free, stop, waitedTooLong := int64(0), p.freeSpace, p.stop, p.waitedTooLong
+		if p.journal != nil {
+			usage = p.journal.Size()
+		}
+		evicted := false
+		if status != DiskOK && p.options.DiskPolicy == EvictOldest {
+			evicted = p.evictOldest()
+		}
+		p.mtx.Unlock()
+
+		if changed {
+			p.reportStatus(status, usage, free)
+		}
+		if status == DiskOK {
+			return nil
+		}
+
+		switch p.options.DiskPolicy {
+		case EvictOldest:
+			if !evicted {
+				return fmt.Errorf("No segment to evict, disk status %v", status)
+			}
+		case ApplyBackpressure:
+			if stop == nil {
+				return fmt.Errorf("Stopped waiting for room, disk status %v", status)
+			}
+			if waitedTooLong {
+				return fmt.Errorf("Not waiting for room again, disk status %v", status)
+			}
+			if ticker == nil {
+				ticker = p.clock.NewTicker(p.options.DiskCheckInterval)
+				started = p.clock.Now()
+			} else if p.clock.Now().Sub(started) >= p.options.MaxBackpressure {
+				p.mtx.Lock()
+				p.waitedTooLong = true
+				p.mtx.Unlock()
+				return fmt.Errorf("Waited too long for room, disk status %v", status)
+			}
+			select {
+			case <-ticker.Chan():
+			case <-stop:
+				return fmt.Errorf("Stopped waiting for room, disk status %v", status)
+			}
+		default:
+			return fmt.Errorf("Not persisting, disk status %v", status)
+		}
+	}
+}
+
+// checkDisk returns the disk status, and whether it changed. It must be called
+// with the lock held.
+func (p *Persister) checkDisk() (DiskStatus, bool) {
+	if p.journal == nil {
+		return p.diskStatus, false
+	}
+
+	maxUsage, minFree := p.options.MaxDiskUsage, p.options.MinFreeSpace
+	switch p.diskStatus {
+	case DiskQuotaExceeded:
+		maxUsage -= maxUsage / 10
+	case DiskLowSpace:
+		minFree += minFree / 10
+	}
+
+	status := DiskOK
+	if maxUsage > 0 && p.journal.Size() >= maxUsage {
+		status = DiskQuotaExceeded
+	} else if minFree > 0 && !p.noFreeSpace {
+		now := p.clock.Now()
+		if p.freeCheckedAt.IsZero() || now.Sub(p.freeCheckedAt) >= p.options.DiskCheckInterval {
+			free, err := journal.FreeSpace(p.options.PersistPath)
+			if err != nil {
+				log.Errorf("Error checking free space, not checking it again: %v", err)
+				p.noFreeSpace = true
+			} else {
+				p.freeSpace = free
+				p.freeCheckedAt = now
+			}
+		}
+		if !p.noFreeSpace && p.freeSpace < minFree {
+			status = DiskLowSpace
+		}
+	}
+
+	changed := status != p.diskStatus
+	p.diskStatus = status
+	return status, changed
+}
+
+// evictOldest deletes the oldest segment, and gives up on the events in it.
+// It must be called with the lock held.
+func (p *Persister) evictOldest() bool {
+	segments := p.journal.Segments()
+	if len(segments) < 2 {
+		return false
+	}
+	n := segments[0]
+	if err := p.journal.Evict(n); err != nil {
+		log.Errorf("Error evicting journal segment %d: %v", n, err)
+		return false
+	}
+	upTo := p.segmentSeqs[n]
+	delete(p.segmentSeqs, n)
+	log.Errorf("Evicted journal segment %d to make room, events up to %d won't be replayed", n, upTo)
+
+	for evt, pe := range p.pending {
+		if pe.seq <= upTo {
+			p.removePending(evt, pe)
+		}
+	}
+	if p.acked < upTo {
+		for seq := range p.ackedSeqs {
+			if seq <= upTo {
+				delete(p.ackedSeqs, seq)
+			}
+		}
+		p.acked = upTo
+	}
+	for p.ackedSeqs[p.acked+1] {
+		delete(p.ackedSeqs, p.acked+1)
+		p.acked++
+	}
+
+	// The space freed shows at once
+	p.freeCheckedAt = time.Time{}
+	return true
+}
+
+func (p *Persister) reportStatus(status DiskStatus, usage int64, free uint64) {
+	if status == DiskOK {
+		log.Debugf("Persister %v has room in the disk again", p.ID())
+	} else {
+		log.Errorf("Persister %v is out of room in the disk: %v", p.ID(), status)
+	}
+
+	err := p.ProcessorBase.Send(events.NewEvent("", &events.Vals{
+		string(events.SystemEventStatus): nil,
+		PersisterIDVal:                   p.ID(),
+		PersisterDiskStatusVal:           status.String(),
+		PersisterDiskUsageVal:            usage,
+		PersisterFreeSpaceVal:            free,
+	}))
+	if err != nil {
+		log.Errorf("Error sending status event: %v", err)
+	}
+}
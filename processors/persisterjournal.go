@@ -0,0 +1,93 @@
+// The records of the Persister journal, and the maintenance of journals not in
+// use, for tools that inspect them.
+
+package processors
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	events "github.com/getlantern/events-pipeline"
+	"github.com/getlantern/events-pipeline/journal"
+)
+
+type JournalRecordType uint8
+
+const (
+	JournalEvent  JournalRecordType = 1
+	JournalCommit JournalRecordType = 2
+	// Written on every start that replays events, with the last one's sequence
+	// number
+	JournalReplay JournalRecordType = 3
+)
+
+func (t JournalRecordType) String() string {
+	switch t {
+	case JournalEvent:
+		return "event"
+	case JournalCommit:
+		return "commit"
+	case JournalReplay:
+		return "replay"
+	}
+	return "unknown"
+}
+
+type JournalRecord struct {
+	Type JournalRecordType
+	// Of the event, or up to which all the events are committed or replayed
+	Seq         uint64
+	Event       *events.Event
+	PersistedAt time.Time
+}
+
+// Encode encodes the record on its own, so it can be decoded without the ones
+// before it
+func (r *JournalRecord) Encode() ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(r); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func DecodeJournalRecord(b []byte) (*JournalRecord, error) {
+	r := new(JournalRecord)
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// LastCommit returns the sequence number up to which the events of the journal
+// in the directory are committed. The keys are needed if it's encrypted.
+func LastCommit(dir string, keys journal.KeyProvider) (uint64, error) {
+	var committed uint64
+	_, err := journal.ScanDir(dir, keys, func(pos journal.Position, rec []byte) error {
+		if r, err := DecodeJournalRecord(rec); err == nil && r.Type == JournalCommit {
+			committed = r.Seq
+		}
+		return nil
+	})
+	return committed, err
+}
+
+// CompactJournal rewrites the journal in the directory with only the events not
+// committed, the replay records that count their replays, and the last commit
+// record, which tells where the sequence numbers are. It must not be used while
+// a Persister has the journal open.
+func CompactJournal(dir string, keys journal.KeyProvider) (kept int, err error) {
+	committed, err := LastCommit(dir, keys)
+	if err != nil {
+		return 0, err
+	}
+	return journal.Compact(dir, keys, func(pos journal.Position, rec []byte) bool {
+		r, err := DecodeJournalRecord(rec)
+		if err != nil {
+			return false
+		}
+		return (r.Type != JournalCommit && r.Seq > committed) ||
+			(r.Type == JournalCommit && r.Seq == committed)
+	})
+}
@@ -0,0 +1,120 @@
+// Migration of the journal of older Persisters
+// Before the journal was split in segments, PersistPath was a single file with
+// the events encoded one after the other with gob, and every write added again
+// all the events since the start, so the same events are there many times. On
+// start, such a file is turned into a journal with its events not committed,
+// which are replayed.
+
+package processors
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+
+	events "github.com/getlantern/events-pipeline"
+	"github.com/getlantern/events-pipeline/journal"
+)
+
+// migrateJournal turns the file at PersistPath into a journal, if it's one of
+// an older Persister. The journal is written aside, and the file is kept
+// until the journal takes its place, so a crash while migrating leaves the file
+// to migrate again.
+func (p *Persister) migrateJournal() error {
+	path := p.options.PersistPath
+	old, migrating := path+".old", path+".migrating"
+
+	// A crash left the file moved aside
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := os.Stat(old); err == nil {
+			if err := os.Rename(old, path); err != nil {
+				return err
+			}
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		// Nothing to migrate
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	evts := decodeOldJournal(b)
+
+	if err := os.RemoveAll(migrating); err != nil {
+		return err
+	}
+	j, err := journal.Open(p.journalOptions(migrating))
+	if err != nil {
+		return err
+	}
+	for i, evt := range evts {
+		rec, err := (&JournalRecord{Type: JournalEvent, Seq: uint64(i + 1), Event: evt, PersistedAt: evt.Timestamp}).Encode()
+		if err == nil {
+			_, err = j.Append(rec)
+		}
+		if err != nil {
+			j.Close()
+			return err
+		}
+	}
+	if err := j.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, old); err != nil {
+		return err
+	}
+	if err := os.Rename(migrating, path); err != nil {
+		return err
+	}
+	log.Debugf("Migrated %v events of the journal of an older Persister", len(evts))
+	return os.Remove(old)
+}
+
+// decodeOldJournal returns the events of an older journal file, once each and
+// in order. Every write started a gob stream again, with its type definitions,
+// and decoding starts again where a duplicated type is found. Decoding stops at
+// anything else that can't be decoded, i.e. a write cut short by a crash.
+func decodeOldJournal(b []byte) []*events.Event {
+	type eventID struct {
+		key       events.Key
+		timestamp int64
+	}
+	var (
+		evts []*events.Event
+		seen = make(map[eventID]bool)
+	)
+	r := bytes.NewReader(b)
+	for r.Len() > 0 {
+		dec := gob.NewDecoder(r)
+		decoded := 0
+		for {
+			start := r.Len()
+			evt := new(events.Event)
+			if err := dec.Decode(evt); err != nil {
+				if err != io.EOF && decoded > 0 {
+					// Starting again at the new stream
+					r.Seek(int64(len(b)-start), io.SeekStart)
+					break
+				}
+				return evts
+			}
+			decoded++
+			id := eventID{evt.Key, evt.Timestamp.UnixNano()}
+			if !seen[id] {
+				seen[id] = true
+				evts = append(evts, evt)
+			}
+		}
+	}
+	return evts
+}
@@ -1,13 +1,20 @@
 package processors
 
 import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/getlantern/testify/assert"
 
 	events "github.com/getlantern/events-pipeline"
+	"github.com/getlantern/events-pipeline/journal"
 )
 
 // Null Sink
@@ -48,6 +55,157 @@ func (c *CallbackSink) Receive(e *events.Event) error {
 	return c.SinkBase.Receive(e)
 }
 
+// System Callback Sink
+// Unlike the Callback Sink, it also performs the callback on system events
+type SystemCallbackSink struct {
+	*events.SinkBase
+	callback func(e *events.Event)
+}
+
+func NewSystemCallbackSink(id string, cb func(e *events.Event)) *SystemCallbackSink {
+	return &SystemCallbackSink{
+		SinkBase: events.NewSinkBase(id),
+		callback: cb,
+	}
+}
+
+func (c *SystemCallbackSink) Receive(e *events.Event) error {
+	c.callback(e)
+	return c.SinkBase.Receive(e)
+}
+
+// Func Sink
+// Returns whatever the function does for the events, except for system events
+type FuncSink struct {
+	*events.SinkBase
+	fn func(e *events.Event) error
+}
+
+func NewFuncSink(id string, fn func(e *events.Event) error) *FuncSink {
+	return &FuncSink{
+		SinkBase: events.NewSinkBase(id),
+		fn:       fn,
+	}
+}
+
+func (s *FuncSink) Receive(e *events.Event) error {
+	if e.Key == "" {
+		return s.SinkBase.Receive(e)
+	}
+	return s.fn(e)
+}
+
+// Records the disk status of the SystemEventStatus events
+type statusRecorder struct {
+	*events.SinkBase
+	statuses *[]interface{}
+	mtx      *sync.Mutex
+}
+
+func (s *statusRecorder) Receive(e *events.Event) error {
+	if _, ok := e.Vals[string(events.SystemEventStatus)]; ok && e.Key == "" {
+		s.mtx.Lock()
+		*s.statuses = append(*s.statuses, e.Vals[PersisterDiskStatusVal])
+		s.mtx.Unlock()
+	}
+	return s.SinkBase.Receive(e)
+}
+
+// Test Clock
+// Time only moves when told to, firing the tickers that are due
+type testClock struct {
+	now     time.Time
+	tickers []*testTicker
+	mtx     sync.Mutex
+}
+
+type testTicker struct {
+	clock   *testClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *testClock) NewTicker(d time.Duration) events.Ticker {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t := &testTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		if t.stopped || t.next.After(c.now) {
+			continue
+		}
+		for !t.next.After(c.now) {
+			t.next = t.next.Add(t.period)
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+}
+
+// Waits until the clock has some ticker
+func (c *testClock) WaitForTickers(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		c.mtx.Lock()
+		n := len(c.tickers)
+		c.mtx.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("No ticker was created")
+}
+
+// Waits until every ticker of the clock has been stopped
+func (c *testClock) WaitForTickersStopped(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		c.mtx.Lock()
+		running := 0
+		for _, ticker := range c.tickers {
+			if !ticker.stopped {
+				running++
+			}
+		}
+		c.mtx.Unlock()
+		if running == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Some ticker wasn't stopped")
+}
+
+func (t *testTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *testTicker) Stop() {
+	t.clock.mtx.Lock()
+	t.stopped = true
+	t.clock.mtx.Unlock()
+}
+
 func TestIdentityProcessor(t *testing.T) {
 	emitter := events.NewEmitterBase("test-emitter", nil)
 	sink := NewNullSink("test-sink")
@@ -123,6 +281,93 @@ func TestAggregator(t *testing.T) {
 	pipeline.Stop()
 }
 
+func TestAggregatorMultipleDirectives(t *testing.T) {
+	evs := make(chan *events.Event, 3)
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	sink := NewCallbackSink("test-sink", func(e *events.Event) {
+		log.Tracef("Entering callback with event %v", e)
+		evs <- e
+	})
+
+	aggregator := NewAggregatorWithOptions(
+		"test-aggregator",
+		&AggregatorOptions{Directives: []AggregationDirectiveOptions{{Output: "level_sum"}, {Output: "level_avg"}}},
+		AggregationDirective{Key: "Karma", Val: "level", AggregatorFunc: AggregatorFloat64RunningSum, Identity: 0.0},
+		AggregationDirective{Key: "Karma", Val: "level", AggregatorFunc: AggregatorFloat64MovingAverage, Identity: MovingAverageIdentity},
+		AggregationDirective{Key: "Karma", Val: "level", AggregatorFunc: AggregatorMax},
+		AggregationDirective{Key: "Karma", Val: "depth", AggregatorFunc: AggregatorIntRunningSum, Identity: RunningSumIdentity},
+	)
+
+	pipeline := events.NewPipeline(emitter)
+	_, err := pipeline.Plug(emitter, aggregator)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(aggregator, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+
+	emitter.Emit("Karma", &events.Vals{"level": 2.0, "depth": 1})
+	<-evs
+	emitter.Emit("Karma", &events.Vals{"level": 4.0, "depth": 2})
+	e := <-evs
+	assert.Equal(t, 6.0, e.Vals["level_sum"], "Should hold the sum")
+	assert.Equal(t, 3.0, e.Vals["level_avg"], "Should hold the average")
+	assert.Equal(t, 4.0, e.Vals["level"], "Should hold the maximum")
+	assert.Equal(t, 3, e.Vals["depth"], "Should hold the sum of the other field")
+
+	pipeline.Stop()
+}
+
+func TestAggregatorGroupBy(t *testing.T) {
+	evs := make(chan *events.Event, 3)
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	sink := NewCallbackSink("test-sink", func(e *events.Event) {
+		log.Tracef("Entering callback with event %v", e)
+		evs <- e
+	})
+
+	aggregator := NewAggregatorWithOptions(
+		"test-aggregator",
+		&AggregatorOptions{Directives: []AggregationDirectiveOptions{{GroupBy: []string{"country"}, MaxGroups: 2}}},
+		AggregationDirective{Key: "Karma", Val: "level", AggregatorFunc: AggregatorIntRunningSum, Identity: RunningSumIdentity},
+	)
+
+	pipeline := events.NewPipeline(emitter)
+	_, err := pipeline.Plug(emitter, aggregator)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(aggregator, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+
+	emitter.Emit("Karma", &events.Vals{"level": 20, "country": "ES"})
+	e := <-evs
+	assert.Equal(t, 20, e.Vals["level"], "Should hold this value")
+
+	emitter.Emit("Karma", &events.Vals{"level": 10, "country": "IR"})
+	e = <-evs
+	assert.Equal(t, 10, e.Vals["level"], "Groups should be aggregated separately")
+
+	emitter.Emit("Karma", &events.Vals{"level": 20, "country": "ES"})
+	e = <-evs
+	assert.Equal(t, 40, e.Vals["level"], "Should hold this value")
+	assert.Equal(t, "ES", e.Vals["country"], "Should hold the group value")
+
+	// Over the limit of groups
+	emitter.Emit("Karma", &events.Vals{"level": 5, "country": "CN"})
+	e = <-evs
+	assert.Equal(t, 5, e.Vals["level"], "Should hold this value")
+	assert.Equal(t, OverflowGroup, e.Vals["country"], "Should be in the overflow group")
+
+	emitter.Emit("Karma", &events.Vals{"level": 5, "country": "RU"})
+	e = <-evs
+	assert.Equal(t, 10, e.Vals["level"], "Should aggregate the overflow group")
+
+	pipeline.Stop()
+}
+
 func TestCondenser(t *testing.T) {
 	evs := make(chan *events.Event, 3)
 
@@ -156,8 +401,8 @@ func TestCondenser(t *testing.T) {
 	pipeline.Stop()
 }
 
-func TestKeyRateLimiter(t *testing.T) {
-	evs := make(chan *events.Event, 3)
+func TestCondenserDirectives(t *testing.T) {
+	evs := make(chan *events.Event, 10)
 
 	emitter := events.NewEmitterBase("test-emitter", nil)
 	sink := NewCallbackSink("test-sink", func(e *events.Event) {
@@ -165,86 +410,2037 @@ func TestKeyRateLimiter(t *testing.T) {
 		evs <- e
 	})
 
-	ratelimiter := NewKeyRateLimiter(
-		"test-ratelimiter",
-		&KeyRateLimiterOptions{Interval: time.Minute, MaxPerInterval: 2},
+	condenser := NewCondenser(
+		"test-condenser",
+		&CondenserOptions{MaxEvents: 15},
+		CondenserDirective{Key: "Max", Type: KeepMax, Field: "level"},
+		CondenserDirective{Key: "Min", Type: KeepMin, Field: "level"},
+		CondenserDirective{Key: "Merge", Type: MergeVals},
+		CondenserDirective{Key: "Count", Type: CountOccurrences},
+		CondenserDirective{Key: "Span", Type: KeepFirstAndLast},
+		CondenserDirective{Key: "Custom", Type: Reduce, Reducer: func(kept, evt *events.Event) *events.Event {
+			// Keep the longest message
+			if kept == nil || len(evt.Vals["msg"].(string)) > len(kept.Vals["msg"].(string)) {
+				return evt
+			}
+			return kept
+		}},
 	)
 
 	pipeline := events.NewPipeline(emitter)
-	_, err := pipeline.Plug(emitter, ratelimiter)
+	_, err := pipeline.Plug(emitter, condenser)
 	assert.Nil(t, err, "Should be nil")
-	_, err = pipeline.Plug(ratelimiter, sink)
+	_, err = pipeline.Plug(condenser, sink)
 	assert.Nil(t, err, "Should be nil")
 
 	pipeline.Run()
 
-	emitter.Emit("Wisdom", &events.Vals{})
-	emitter.Emit("Wisdom", &events.Vals{})
-	emitter.Emit("Wisdom", &events.Vals{})
+	base := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	send := func(k events.Key, vals events.Vals, offset time.Duration) {
+		evt := events.NewEvent(k, &vals)
+		evt.Timestamp = base.Add(offset)
+		emitter.Send(evt)
+	}
+	for _, l := range []int{3, 9, 1} {
+		send("Max", events.Vals{"level": l}, 0)
+		send("Min", events.Vals{"level": l}, 0)
+	}
+	send("Merge", events.Vals{"a": 1, "b": 1}, 0)
+	send("Merge", events.Vals{"b": 2, "c": 2}, 0)
+	send("Count", events.Vals{"n": 1}, 0)
+	send("Count", events.Vals{"n": 2}, 0)
+	send("Count", events.Vals{"n": 3}, 0)
+	send("Span", events.Vals{"n": 1}, 0)
+	send("Span", events.Vals{"n": 2}, time.Minute)
+	send("Custom", events.Vals{"msg": "Hi"}, 0)
+	send("Custom", events.Vals{"msg": "Hello"}, 0)
 
-	time.Sleep(20 * time.Millisecond)
+	received := make(map[events.Key][]*events.Event)
+	for i := 0; i < 7; i++ {
+		select {
+		case e := <-evs:
+			received[e.Key] = append(received[e.Key], e)
+		case <-time.After(time.Second):
+			t.Fatalf("Only %v condensed events reached the sink", i)
+		}
+	}
 
-	assert.Equal(t, 2, len(evs), "Only two events should have arrived to the sink")
+	assert.Equal(t, 9, received["Max"][0].Vals["level"], "Should keep the maximum")
+	assert.Equal(t, 1, received["Min"][0].Vals["level"], "Should keep the minimum")
+	assert.Equal(t, events.Vals{"a": 1, "b": 2, "c": 2}, received["Merge"][0].Vals, "Should merge the Vals")
+	assert.Equal(t, 3, received["Count"][0].Vals["n"], "Should keep the last event")
+	assert.Equal(t, int64(3), received["Count"][0].Vals[CondenserCountVal], "Should count the events")
+	if assert.Equal(t, 2, len(received["Span"]), "Should keep the first and last events") {
+		assert.Equal(t, 1, received["Span"][0].Vals["n"], "Should send the first event first")
+		assert.Equal(t, time.Minute, received["Span"][1].Vals[CondenserDurationVal], "Should hold the duration")
+	}
+	assert.Equal(t, "Hello", received["Custom"][0].Vals["msg"], "Should keep what the reducer returns")
 
 	pipeline.Stop()
 }
 
-func TestPersister(t *testing.T) {
-	persistPath := "test-persister"
-	defer func() {
-		if _, err := os.Stat(persistPath); err == nil {
-			err := os.Remove(persistPath)
-			if err != nil {
-				log.Errorf("Error removing Persister recovery file: %v", err)
-				return
-			}
-		}
-	}()
+func TestCondenserSampling(t *testing.T) {
+	evs := make(chan *events.Event, 20)
 
 	emitter := events.NewEmitterBase("test-emitter", nil)
-	sink := NewNullSink("test-sink")
-	persister := NewPersister(
-		"test-processor",
-		&PersisterOptions{
-			MaxEvents:   2,
-			PersistPath: persistPath,
-		})
+	sink := NewCallbackSink("test-sink", func(e *events.Event) {
+		log.Tracef("Entering callback with event %v", e)
+		evs <- e
+	})
+
+	condenser := NewCondenser(
+		"test-condenser",
+		&CondenserOptions{MaxEvents: 200},
+		CondenserDirective{Key: "Curiosity", Type: KeepSample, SampleSize: 5},
+		CondenserDirective{Key: "Diligence", Type: KeepSample, SampleSize: 5, WeightField: "weight"},
+	)
+
 	pipeline := events.NewPipeline(emitter)
-	_, err := pipeline.Plug(emitter, persister)
+	_, err := pipeline.Plug(emitter, condenser)
 	assert.Nil(t, err, "Should be nil")
-	_, err = pipeline.Plug(persister, sink)
+	_, err = pipeline.Plug(condenser, sink)
 	assert.Nil(t, err, "Should be nil")
 
 	pipeline.Run()
 
-	evt := events.NewEvent("Colors", &events.Vals{"Beauty": "Imperfection"})
+	for i := 0; i < 100; i++ {
+		emitter.Emit("Curiosity", &events.Vals{"n": i})
+		// Only the events with weight can be sampled
+		weight := 0
+		if i%10 == 0 {
+			weight = 1
+		}
+		emitter.Emit("Diligence", &events.Vals{"n": i, "weight": weight})
+	}
+
+	seen := make(map[events.Key]map[interface{}]bool)
+	for i := 0; i < 10; i++ {
+		select {
+		case e := <-evs:
+			if seen[e.Key] == nil {
+				seen[e.Key] = make(map[interface{}]bool)
+			}
+			seen[e.Key][e.Vals["n"]] = true
+			assert.Equal(t, int64(100), e.Vals[CondenserCountVal], "Should carry the number of events seen")
+			if e.Key == "Diligence" {
+				assert.Equal(t, 0, e.Vals["n"].(int)%10, "Should only sample events with weight")
+				assert.Equal(t, 10.0, e.Vals[CondenserWeightTotalVal], "Should carry the sum of the weights seen")
+			} else {
+				assert.Nil(t, e.Vals[CondenserWeightTotalVal], "Only weighted samples have weights")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Only %v sampled events reached the sink", i)
+		}
+	}
+	assert.Equal(t, 5, len(seen["Curiosity"]), "Should sample different events")
+	assert.Equal(t, 5, len(seen["Diligence"]), "Should sample different events")
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, len(evs), "No other events should have arrived to the sink")
+
+	pipeline.Stop()
+}
+
+func TestCondenserOverflow(t *testing.T) {
+	spillPath := "test-condenser-spill"
+	defer os.Remove(spillPath)
+
+	for _, c := range []struct {
+		options *CondenserOptions
+		keys    []events.Key
+		sent    []int
+		dropped uint64
+		spilled uint64
+	}{
+		{
+			options: &CondenserOptions{MaxEvents: 5, MaxPerKey: 2, OverflowPolicy: DropOldest},
+			keys:    []events.Key{"A", "A", "A", "B", "B"},
+			sent:    []int{1, 2, 3, 4},
+			dropped: 1,
+		},
+		{
+			options: &CondenserOptions{MaxEvents: 5, MaxPerKey: 1, OverflowPolicy: DropNewest},
+			keys:    []events.Key{"A", "A", "B", "A", "B"},
+			sent:    []int{0, 2},
+			dropped: 3,
+		},
+		{
+			// Room for a couple of events, after the first one
+			options: &CondenserOptions{MaxEvents: 5, MaxBytes: 200, OverflowPolicy: SpillToDisk, SpillPath: spillPath},
+			keys:    []events.Key{"A", "A", "A", "A", "A"},
+			sent:    []int{0, 1, 2, 3, 4},
+			spilled: 3,
+		},
+	} {
+		evs := make(chan *events.Event, 10)
+
+		emitter := events.NewEmitterBase("test-emitter", nil)
+		sink := NewSystemCallbackSink("test-sink", func(e *events.Event) {
+			log.Tracef("Entering callback with event %v", e)
+			evs <- e
+		})
+		condenser := NewCondenser("test-condenser", c.options)
+
+		pipeline := events.NewPipeline(emitter)
+		_, err := pipeline.Plug(emitter, condenser)
+		assert.Nil(t, err, "Should be nil")
+		_, err = pipeline.Plug(condenser, sink)
+		assert.Nil(t, err, "Should be nil")
+
+		pipeline.Run()
+
+		for i, k := range c.keys {
+			emitter.Emit(k, &events.Vals{"n": i, "padding": "Sometimes the bravest thing is to let go"})
+		}
+
+		var sent []int
+		for {
+			e := <-evs
+			if _, ok := e.Vals[string(events.SystemEventMark)]; ok {
+				assert.Equal(t, c.dropped, e.Vals[CondenserDroppedVal], "Should report the events dropped")
+				assert.Equal(t, c.spilled, e.Vals[CondenserSpilledVal], "Should report the events spilled")
+				break
+			} else if e.Key != "" {
+				sent = append(sent, e.Vals["n"].(int))
+			}
+		}
+		assert.Equal(t, c.sent, sent, "Should send the events kept, in order")
 
-	if err := persister.persistEvent(evt); err != nil {
-		assert.Nil(t, err, "Error should be nil")
+		pipeline.Stop()
 	}
+}
+
+func TestCondenserTimeFlush(t *testing.T) {
+	evs := make(chan *events.Event, 50)
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	sink := NewCallbackSink("test-sink", func(e *events.Event) {
+		log.Tracef("Entering callback with event %v", e)
+		evs <- e
+	})
 
-	// Force opening with both read and write permissions, defying the logic of the Persister
-	persister.journalFile, err = os.OpenFile(
-		persister.options.PersistPath,
-		os.O_RDWR|os.O_CREATE,
-		0666,
+	condenser := NewCondenser(
+		"test-condenser",
+		&CondenserOptions{
+			IdleTimeout:   10 * time.Second,
+			MaxAge:        time.Minute,
+			CheckInterval: time.Second,
+		},
 	)
-	if err != nil {
-		log.Errorf("Error opening or creating event recovery file: %v", err)
+
+	clock := newTestClock()
+	pipeline := events.NewPipeline(emitter)
+	pipeline.SetClock(clock)
+	_, err := pipeline.Plug(emitter, condenser)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(condenser, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+	clock.WaitForTickers(t)
+
+	waitEvents := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case <-evs:
+			case <-time.After(time.Second):
+				t.Fatalf("Only %v events out of %v reached the sink", i, n)
+			}
+		}
 	}
 
-	persister.b.Reset()
+	// Flush on idle
+	emitter.Emit("Empathy", &events.Vals{})
+	emitter.Emit("Empathy", &events.Vals{})
+	time.Sleep(time.Millisecond)
+	clock.Advance(5 * time.Second)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, len(evs), "Events shouldn't have reached the sink")
+	clock.Advance(5 * time.Second)
+	waitEvents(2)
 
-	evts, err := persister.recoverEvents()
-	if err != nil {
-		t.Fatalf("Error recovering events: %v", err)
+	// Flush on max age, even if events keep coming
+	for i := 0; i < 25; i++ {
+		emitter.Emit("Empathy", &events.Vals{})
+		// Let the condenser see the event before moving the clock
+		time.Sleep(time.Millisecond)
+		clock.Advance(2 * time.Second)
 	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, len(evs), "Events shouldn't have reached the sink")
+	for i := 0; i < 5; i++ {
+		emitter.Emit("Empathy", &events.Vals{})
+		// Let the condenser see the event before moving the clock
+		time.Sleep(time.Millisecond)
+		clock.Advance(2 * time.Second)
+	}
+	waitEvents(30)
 
-	if assert.Equal(t, 1, len(evts), "One event should have been recovered") {
-		assert.Equal(t, *evt, evts[0], "The recovered event should be the last one emitted")
+	pipeline.Stop()
+	assert.Equal(t, 0, len(evs), "No other events should have arrived to the sink")
+}
+
+func TestCondenserTimeout(t *testing.T) {
+	evs := make(chan *events.Event, 10)
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	sink := NewCallbackSink("test-sink", func(e *events.Event) {
+		evs <- e
+	})
+
+	condenser := NewCondenser("test-condenser", &CondenserOptions{Timeout: time.Minute})
+
+	clock := newTestClock()
+	pipeline := events.NewPipeline(emitter)
+	pipeline.SetClock(clock)
+	_, err := pipeline.Plug(emitter, condenser)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(condenser, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+	clock.WaitForTickers(t)
+
+	// Waits until the condenser holds this many events
+	buffered := func(n uint64) {
+		for i := 0; i < 100; i++ {
+			condenser.evMtx.Lock()
+			numEvs := condenser.numEvs
+			condenser.evMtx.Unlock()
+			if numEvs == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("The condenser doesn't hold %v events", n)
+	}
+	waitEvents := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case <-evs:
+			case <-time.After(time.Second):
+				t.Fatalf("Only %v events out of %v reached the sink", i, n)
+			}
+		}
 	}
 
-	time.Sleep(100 * time.Millisecond)
+	// Flushed every timeout, however recent the events
+	clock.Advance(30 * time.Second)
+	emitter.Emit("Empathy", &events.Vals{})
+	emitter.Emit("Empathy", &events.Vals{})
+	buffered(2)
+	clock.Advance(30 * time.Second)
+	waitEvents(2)
+
+	emitter.Emit("Empathy", &events.Vals{})
+	buffered(1)
+	clock.Advance(30 * time.Second)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, len(evs), "Events shouldn't have reached the sink before the timeout")
+	clock.Advance(30 * time.Second)
+	waitEvents(1)
+
+	// No flushes after the pipeline stops
+	pipeline.Stop()
+	clock.WaitForTickersStopped(t)
+	assert.Equal(t, 0, len(evs), "No other events should have arrived to the sink")
+}
+
+func TestKeyRateLimiter(t *testing.T) {
+	evs := make(chan *events.Event, 3)
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	sink := NewCallbackSink("test-sink", func(e *events.Event) {
+		log.Tracef("Entering callback with event %v", e)
+		evs <- e
+	})
+
+	ratelimiter := NewKeyRateLimiter(
+		"test-ratelimiter",
+		&KeyRateLimiterOptions{Interval: time.Minute, MaxPerInterval: 2},
+	)
+
+	pipeline := events.NewPipeline(emitter)
+	_, err := pipeline.Plug(emitter, ratelimiter)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(ratelimiter, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+
+	emitter.Emit("Wisdom", &events.Vals{})
+	emitter.Emit("Wisdom", &events.Vals{})
+	emitter.Emit("Wisdom", &events.Vals{})
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Equal(t, 2, len(evs), "Only two events should have arrived to the sink")
+
+	pipeline.Stop()
+}
+
+func TestKeyRateLimiterDropSummaries(t *testing.T) {
+	evs := make(chan *events.Event, 10)
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	sink := NewCallbackSink("test-sink", func(e *events.Event) {
+		evs <- e
+	})
+
+	ratelimiter := NewKeyRateLimiter(
+		"test-ratelimiter",
+		&KeyRateLimiterOptions{Interval: time.Minute, MaxPerInterval: 1, DropSummaries: true},
+	)
+
+	clock := newTestClock()
+	pipeline := events.NewPipeline(emitter)
+	pipeline.SetClock(clock)
+	_, err := pipeline.Plug(emitter, ratelimiter)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(ratelimiter, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+	clock.WaitForTickers(t)
+
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, k := range []events.Key{"Wisdom", "Wisdom", "Wisdom", "Wisdom", "Empathy"} {
+		evt := events.NewEvent(k, &events.Vals{})
+		evt.Timestamp = start.Add(time.Duration(i) * time.Second)
+		emitter.Send(evt)
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 2, len(evs), "One event per key should have arrived to the sink")
+	<-evs
+	<-evs
+
+	clock.Advance(time.Minute)
+	summary := <-evs
+	assert.Equal(t, events.Key("Wisdom"+DropSummaryKeySuffix), summary.Key, "Should be a drop summary")
+	assert.Equal(t, int64(3), summary.Vals[DroppedCountVal], "Should hold this value")
+	assert.Equal(t, start.Add(time.Second), summary.Vals[FirstDroppedVal], "Should hold this value")
+	assert.Equal(t, start.Add(3*time.Second), summary.Vals[LastDroppedVal], "Should hold this value")
+
+	// The counts start over
+	emitter.Emit("Wisdom", &events.Vals{})
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, len(evs), "A new interval should have begun")
+
+	pipeline.Stop()
+}
+
+func TestQuotaProcessor(t *testing.T) {
+	statePath := "test-quota-state"
+	defer os.Remove(statePath)
+
+	evs := make(chan *events.Event, 10)
+	clock := newTestClock()
+
+	run := func(policy OverQuotaPolicy, fn func(*QuotaProcessor, *events.EmitterBase)) {
+		emitter := events.NewEmitterBase("test-emitter", nil)
+		sink := NewCallbackSink("test-sink", func(e *events.Event) {
+			evs <- e
+		})
+		quota := NewQuotaProcessor("test-quota", &QuotaOptions{
+			Limit:     2,
+			Location:  time.FixedZone("UTC+2", 2*60*60),
+			Policy:    policy,
+			StatePath: statePath,
+			// Restored counters are expired with it as soon as they are loaded
+			Clock: clock,
+		})
+
+		pipeline := events.NewPipeline(emitter)
+		_, err := pipeline.Plug(emitter, quota)
+		assert.Nil(t, err, "Should be nil")
+		_, err = pipeline.Plug(quota, sink)
+		assert.Nil(t, err, "Should be nil")
+
+		pipeline.Run()
+		fn(quota, emitter)
+		pipeline.Stop()
+	}
+
+	received := func() []*events.Event {
+		time.Sleep(20 * time.Millisecond)
+		var r []*events.Event
+		for len(evs) > 0 {
+			r = append(r, <-evs)
+		}
+		return r
+	}
+
+	run(DropOverQuota, func(quota *QuotaProcessor, emitter *events.EmitterBase) {
+		for i := 0; i < 3; i++ {
+			emitter.Emit("Wisdom", &events.Vals{})
+		}
+		assert.Equal(t, 2, len(received()), "Only the quota should have arrived to the sink")
+		assert.Equal(t, int64(3), quota.Used("Wisdom"), "Should hold this value")
+	})
+
+	// The counters survive a restart
+	run(TagOverQuota, func(quota *QuotaProcessor, emitter *events.EmitterBase) {
+		assert.Equal(t, int64(3), quota.Used("Wisdom"), "Should hold this value")
+		emitter.Emit("Wisdom", &events.Vals{})
+		r := received()
+		if assert.Equal(t, 1, len(r), "Events over quota should be tagged") {
+			assert.Equal(t, true, r[0].Vals[OverQuotaVal], "Should be tagged")
+		}
+
+		// A new day starts at midnight in the quota time zone
+		clock.Advance(21 * time.Hour)
+		emitter.Emit("Wisdom", &events.Vals{})
+		r = received()
+		if assert.Equal(t, 1, len(r), "Should be over quota") {
+			assert.Equal(t, true, r[0].Vals[OverQuotaVal], "Should be tagged")
+		}
+		clock.Advance(time.Hour)
+		emitter.Emit("Wisdom", &events.Vals{})
+		r = received()
+		if assert.Equal(t, 1, len(r), "The quota should have been reset") {
+			assert.Nil(t, r[0].Vals[OverQuotaVal], "Shouldn't be tagged")
+		}
+		assert.Equal(t, int64(1), quota.Used("Wisdom"), "Should hold this value")
+	})
+}
+
+func TestQuotaCheckpoints(t *testing.T) {
+	statePath := "test-quota-checkpoints"
+	defer os.Remove(statePath)
+
+	clock := newTestClock()
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	quota := NewQuotaProcessor("test-quota", &QuotaOptions{
+		Limit:           10,
+		StatePath:       statePath,
+		CheckpointEvery: 3,
+		Clock:           clock,
+	})
+	pipeline := events.NewPipeline(emitter)
+	_, err := pipeline.Plug(emitter, quota)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(quota, NewNullSink("test-sink"))
+	assert.Nil(t, err, "Should be nil")
+	pipeline.Run()
+	defer pipeline.Stop()
+
+	records := func() int {
+		time.Sleep(20 * time.Millisecond)
+		f, err := os.Open(statePath)
+		if !assert.Nil(t, err, "Should be nil") {
+			return 0
+		}
+		defer f.Close()
+		n := 0
+		d := gob.NewDecoder(f)
+		for d.Decode(new(stateRecord)) == nil {
+			n++
+		}
+		return n
+	}
+
+	emitter.Emit("Wisdom", &events.Vals{})
+	emitter.Emit("Courage", &events.Vals{})
+	assert.Equal(t, 2, records(), "Every event should have been written")
+	emitter.Emit("Wisdom", &events.Vals{})
+	assert.Equal(t, 2, records(), "Should have been compacted")
+	emitter.Emit("Wisdom", &events.Vals{})
+	assert.Equal(t, 3, records(), "Should hold this value")
+
+	// The counters of the day past are dropped when the next starts
+	clock.Advance(24 * time.Hour)
+	emitter.Emit("Wisdom", &events.Vals{})
+	assert.Equal(t, 1, records(), "Should have been compacted")
+	assert.Equal(t, int64(1), quota.Used("Wisdom"), "Should hold this value")
+	assert.Equal(t, int64(0), quota.Used("Courage"), "Should hold this value")
+}
+
+func TestAdaptiveRateLimiter(t *testing.T) {
+	changes := make(chan *events.Event, 10)
+	var failing bool
+	var failingMtx sync.Mutex
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	sink := NewFuncSink("test-sink", func(e *events.Event) error {
+		if e.Key == DefaultRateChangeKey {
+			changes <- e
+			return nil
+		}
+		failingMtx.Lock()
+		defer failingMtx.Unlock()
+		if failing {
+			return fmt.Errorf("Sink down")
+		}
+		return nil
+	})
+
+	ratelimiter := NewAdaptiveRateLimiter(
+		"test-ratelimiter",
+		&AdaptiveRateLimiterOptions{Floor: 1, Ceiling: 10, Increase: 2},
+	)
+
+	clock := newTestClock()
+	pipeline := events.NewPipeline(emitter)
+	pipeline.SetClock(clock)
+	_, err := pipeline.Plug(emitter, ratelimiter)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(ratelimiter, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+	clock.WaitForTickers(t)
+
+	setFailing := func(f bool) {
+		failingMtx.Lock()
+		failing = f
+		failingMtx.Unlock()
+	}
+	nextChange := func() *events.Event {
+		select {
+		case e := <-changes:
+			return e
+		case <-time.After(time.Second):
+			t.Fatalf("No rate change was sent")
+			return nil
+		}
+	}
+
+	// Errors halve the rate
+	setFailing(true)
+	emitter.Emit("Wisdom", &events.Vals{})
+	time.Sleep(20 * time.Millisecond)
+	clock.Advance(time.Second)
+	change := nextChange()
+	assert.Equal(t, 5.0, change.Vals[RateVal], "Should hold this value")
+	assert.Equal(t, 10.0, change.Vals[PreviousRateVal], "Should hold this value")
+	assert.Equal(t, CongestionErrors, change.Vals[RateChangeReasonVal], "Should hold this value")
+
+	// Healthy deliveries raise it back up to the ceiling
+	setFailing(false)
+	emitter.Emit("Wisdom", &events.Vals{})
+	time.Sleep(20 * time.Millisecond)
+	for _, rate := range []float64{7, 9, 10} {
+		clock.Advance(time.Second)
+		change = nextChange()
+		assert.Equal(t, rate, change.Vals[RateVal], "Should hold this value")
+		assert.Equal(t, RateIncreased, change.Vals[RateChangeReasonVal], "Should hold this value")
+	}
+	clock.Advance(time.Second)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, len(changes), "The rate shouldn't go over the ceiling")
+	assert.Equal(t, 10.0, ratelimiter.Rate(), "Should hold this value")
+
+	pipeline.Stop()
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	evs := make(chan *events.Event, 20)
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	sink := NewCallbackSink("test-sink", func(e *events.Event) {
+		log.Tracef("Entering callback with event %v", e)
+		evs <- e
+	})
+
+	ratelimiter := NewTokenBucketLimiter(
+		"test-ratelimiter",
+		&TokenBucketLimiterOptions{
+			Default: RateLimitRule{Rate: 1, Burst: 2},
+			Rules: []RateLimitRule{
+				{Pattern: "proxy.*", Rate: 100, Burst: 5},
+				{Pattern: "proxy.noisy", Rate: 0},
+			},
+		},
+	)
+
+	clock := newTestClock()
+	pipeline := events.NewPipeline(emitter)
+	pipeline.SetClock(clock)
+	_, err := pipeline.Plug(emitter, ratelimiter)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(ratelimiter, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+
+	count := func(k events.Key, n int) int {
+		for i := 0; i < n; i++ {
+			emitter.Emit(k, &events.Vals{})
+		}
+		time.Sleep(20 * time.Millisecond)
+		received := len(evs)
+		for len(evs) > 0 {
+			<-evs
+		}
+		return received
+	}
+
+	assert.Equal(t, 2, count("Wisdom", 4), "Only a burst of events should go through")
+	assert.Equal(t, 0, count("Wisdom", 1), "The bucket should be empty")
+	clock.Advance(time.Second)
+	assert.Equal(t, 1, count("Wisdom", 2), "The bucket should have been refilled with one token")
+	assert.Equal(t, 5, count("proxy.eu", 10), "Glob rules should apply")
+	assert.Equal(t, 0, count("proxy.noisy", 3), "Exact rules should take precedence")
+
+	m := ratelimiter.Metrics()
+	assert.Equal(t, uint64(8), m.Allowed, "Should hold this value")
+	assert.Equal(t, uint64(12), m.Throttled, "Should hold this value")
+	assert.Equal(t, uint64(5), m.AllowedByRule["proxy.*"], "Should hold this value")
+	assert.Equal(t, uint64(3), m.ThrottledByRule["proxy.noisy"], "Should hold this value")
+	assert.Equal(t, uint64(4), m.ThrottledByRule[""], "Should hold this value")
+
+	pipeline.Stop()
+}
+
+func TestTokenBucketLimiterMetrics(t *testing.T) {
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	ratelimiter := NewTokenBucketLimiter(
+		"test-ratelimiter",
+		&TokenBucketLimiterOptions{
+			Default: RateLimitRule{Rate: 100},
+			Rules:   []RateLimitRule{{Pattern: "Noisy", Rate: 1}},
+			Scopes: []RateLimitScope{
+				{Type: FieldsScope, Fields: []string{"user"}, Limit: RateLimitRule{Rate: 1}},
+				{Type: KeyScope},
+			},
+		},
+	)
+	pipeline := events.NewPipeline(emitter)
+	pipeline.SetClock(newTestClock())
+	_, err := pipeline.Plug(emitter, ratelimiter)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(ratelimiter, NewNullSink("test-sink"))
+	assert.Nil(t, err, "Should be nil")
+	pipeline.Run()
+	defer pipeline.Stop()
+
+	// Values of different types are different users
+	for _, user := range []interface{}{1, 1, "1", "1"} {
+		emitter.Emit("Wisdom", &events.Vals{"user": user})
+	}
+	time.Sleep(20 * time.Millisecond)
+	m := ratelimiter.Metrics()
+	assert.Equal(t, uint64(2), m.Allowed, "Should hold this value")
+	assert.Equal(t, uint64(2), m.AllowedByRule[""], "Should hold this value")
+	assert.Equal(t, uint64(2), m.ThrottledByScope["fields:user"], "Should hold this value")
+	assert.Empty(t, m.ThrottledByRule, "The key scope didn't discard them")
+
+	// Only the events the key rule discarded are charged to it
+	emitter.Emit("Noisy", &events.Vals{"user": 2})
+	emitter.Emit("Noisy", &events.Vals{"user": 3})
+	time.Sleep(20 * time.Millisecond)
+	m = ratelimiter.Metrics()
+	assert.Equal(t, uint64(1), m.AllowedByRule["Noisy"], "Should hold this value")
+	assert.Equal(t, uint64(1), m.ThrottledByRule["Noisy"], "Should hold this value")
+	assert.Equal(t, uint64(1), m.ThrottledByScope["key"], "Should hold this value")
+}
+
+func TestTokenBucketLimiterScopes(t *testing.T) {
+	evs := make(chan *events.Event, 20)
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	sink := NewCallbackSink("test-sink", func(e *events.Event) {
+		evs <- e
+	})
+
+	ratelimiter := NewTokenBucketLimiter(
+		"test-ratelimiter",
+		&TokenBucketLimiterOptions{
+			Default: RateLimitRule{Rate: 100},
+			Scopes: []RateLimitScope{
+				{Type: KeyScope},
+				{Type: FieldsScope, Fields: []string{"user"}, Limit: RateLimitRule{Rate: 1, Burst: 2}},
+				{Type: GlobalScope, Limit: RateLimitRule{Rate: 1, Burst: 5}},
+			},
+		},
+	)
+
+	clock := newTestClock()
+	pipeline := events.NewPipeline(emitter)
+	pipeline.SetClock(clock)
+	_, err := pipeline.Plug(emitter, ratelimiter)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(ratelimiter, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+
+	count := func(vals events.Vals, n int) int {
+		for i := 0; i < n; i++ {
+			v := events.Vals{}
+			for k, val := range vals {
+				v[k] = val
+			}
+			emitter.Emit("Wisdom", &v)
+		}
+		time.Sleep(20 * time.Millisecond)
+		received := len(evs)
+		for len(evs) > 0 {
+			<-evs
+		}
+		return received
+	}
+
+	assert.Equal(t, 2, count(events.Vals{"user": "alice"}, 4), "Should be limited per user")
+	assert.Equal(t, 2, count(events.Vals{"user": "bob"}, 3), "Users should have their own buckets")
+	assert.Equal(t, 1, count(events.Vals{}, 3), "Events without the field should only have the global cap")
+
+	m := ratelimiter.Metrics()
+	assert.Equal(t, uint64(5), m.Allowed, "Should hold this value")
+	assert.Equal(t, uint64(3), m.ThrottledByScope["fields:user"], "Should hold this value")
+	assert.Equal(t, uint64(2), m.ThrottledByScope["global"], "Should hold this value")
+	assert.Empty(t, m.ThrottledByRule, "No event was discarded by a key rule")
+
+	// The global bucket refills, and the tokens of discarded events were given back
+	clock.Advance(time.Second)
+	assert.Equal(t, 1, count(events.Vals{"user": "carol"}, 2), "Should be limited by the global cap")
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, 2, count(events.Vals{"user": "carol"}, 3), "Carol's bucket should be full")
+
+	pipeline.Stop()
+}
+
+func TestPersister(t *testing.T) {
+	persistPath := "test-persister"
+	defer func() {
+		if _, err := os.Stat(persistPath); err == nil {
+			err := os.RemoveAll(persistPath)
+			if err != nil {
+				log.Errorf("Error removing Persister recovery file: %v", err)
+				return
+			}
+		}
+	}()
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	// Nothing is acknowledged, so everything is kept in the journal
+	sink := NewFuncSink("test-sink", func(e *events.Event) error {
+		return fmt.Errorf("Sink down")
+	})
+	persister := NewPersister(
+		"test-processor",
+		&PersisterOptions{
+			MaxEvents:   2,
+			PersistPath: persistPath,
+		})
+	pipeline := events.NewPipeline(emitter)
+	_, err := pipeline.Plug(emitter, persister)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(persister, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+
+	evt := events.NewEvent("Colors", &events.Vals{"Beauty": "Imperfection"})
+	emitter.Send(evt)
+
+	time.Sleep(100 * time.Millisecond)
+
+	pipeline.Stop()
+
+	evts, err := persister.recoverEvents()
+	if err != nil {
+		t.Fatalf("Error recovering events: %v", err)
+	}
+
+	if assert.Equal(t, 1, len(evts), "One event should have been recovered") {
+		assert.Equal(t, evt.Key, evts[0].Key, "The recovered event should be the last one emitted")
+		assert.Equal(t, evt.Vals, evts[0].Vals, "The recovered event should be the last one emitted")
+		assert.True(t, evt.Timestamp.Equal(evts[0].Timestamp), "The recovered event should be the last one emitted")
+	}
+}
+
+func TestPersisterReplay(t *testing.T) {
+	persistPath := "test-persister-replay"
+	defer os.RemoveAll(persistPath)
+
+	run := func(sinkFn func(e *events.Event) error, fn func(*events.EmitterBase)) *events.Pipeline {
+		emitter := events.NewEmitterBase("test-emitter", nil)
+		sink := NewFuncSink("test-sink", sinkFn)
+		// A commit record for every event acknowledged
+		persister := NewPersister("test-persister", &PersisterOptions{PersistPath: persistPath, MaxEvents: 1})
+		pipeline := events.NewPipeline(emitter)
+		_, err := pipeline.Plug(emitter, persister)
+		assert.Nil(t, err, "Should be nil")
+		_, err = pipeline.Plug(persister, sink)
+		assert.Nil(t, err, "Should be nil")
+
+		pipeline.Run()
+		fn(emitter)
+		time.Sleep(20 * time.Millisecond)
+		return pipeline
+	}
+
+	// The sink goes down after the third event, and the process dies without
+	// stopping the pipeline
+	delivered := 0
+	run(func(e *events.Event) error {
+		if delivered == 3 {
+			return fmt.Errorf("Sink down")
+		}
+		delivered++
+		return nil
+	}, func(emitter *events.EmitterBase) {
+		for i := 0; i < 5; i++ {
+			emitter.Emit("Honesty", &events.Vals{"n": i})
+		}
+	})
+
+	// Exactly the events not acknowledged are replayed
+	var replayed []interface{}
+	pipeline := run(func(e *events.Event) error {
+		replayed = append(replayed, e.Vals["n"])
+		return nil
+	}, func(emitter *events.EmitterBase) {})
+	pipeline.Stop()
+	assert.Equal(t, []interface{}{3, 4}, replayed, "Only the events not acknowledged should be replayed")
+
+	// And not again
+	replayed = nil
+	pipeline = run(func(e *events.Event) error {
+		replayed = append(replayed, e.Vals["n"])
+		return nil
+	}, func(emitter *events.EmitterBase) {})
+	pipeline.Stop()
+	assert.Empty(t, replayed, "Everything should have been committed")
+}
+
+func TestPersisterReplayMetadata(t *testing.T) {
+	persistPath := "test-persister-replay-metadata"
+	defer os.RemoveAll(persistPath)
+
+	var (
+		received []*events.Event
+		mtx      sync.Mutex
+	)
+	receivedEvents := func() []*events.Event {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return append([]*events.Event(nil), received...)
+	}
+	run := func(clock events.Clock, rate float64, down bool, n int) *events.Pipeline {
+		received = nil
+		emitter := events.NewEmitterBase("test-emitter", nil)
+		sink := NewFuncSink("test-sink", func(e *events.Event) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			received = append(received, e)
+			if down {
+				return fmt.Errorf("Sink down")
+			}
+			return nil
+		})
+		persister := NewPersister("test-persister", &PersisterOptions{
+			PersistPath: persistPath,
+			ReplayRate:  rate,
+			Clock:       clock,
+		})
+		pipeline := events.NewPipeline(emitter)
+		_, err := pipeline.Plug(emitter, persister)
+		assert.Nil(t, err, "Should be nil")
+		_, err = pipeline.Plug(persister, sink)
+		assert.Nil(t, err, "Should be nil")
+
+		pipeline.Run()
+		for i := 0; i < n; i++ {
+			emitter.Emit("Kindness", &events.Vals{"n": i})
+		}
+		time.Sleep(20 * time.Millisecond)
+		return pipeline
+	}
+
+	clock := newTestClock()
+	run(clock, 0, true, 3).Stop()
+	for _, e := range receivedEvents() {
+		assert.Nil(t, e.Replay, "Live events should not be marked")
+	}
+
+	run(clock, 0, true, 0).Stop()
+	replayed := receivedEvents()
+	if assert.Equal(t, 3, len(replayed), "Should hold this value") {
+		for i, e := range replayed {
+			if assert.NotNil(t, e.Replay, "Replayed events should be marked") {
+				assert.Equal(t, 1, e.Replay.Count, "Should be the first replay")
+				assert.True(t, e.Replay.PersistedAt.Equal(clock.Now()), "Should hold when the event was persisted")
+				assert.Equal(t, uint64(1), e.Replay.Segment, "Should hold this value")
+				if i > 0 {
+					assert.True(t, e.Replay.Offset > replayed[i-1].Replay.Offset, "Should be where the event is")
+				}
+			}
+		}
+	}
+
+	// At most 10 events per second
+	rateClock := newTestClock()
+	pipeline := run(rateClock, 10, false, 0)
+	assert.Equal(t, 1, len(receivedEvents()), "Only the first event should have been replayed")
+	rateClock.WaitForTickers(t)
+	rateClock.Advance(100 * time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 2, len(receivedEvents()), "Another event should have been replayed")
+	pipeline.Stop()
+	for _, e := range receivedEvents() {
+		assert.Equal(t, 2, e.Replay.Count, "Should be the second replay")
+	}
+
+	// The replay was stopped, so the last event is still there
+	run(clock, 0, false, 0).Stop()
+	if replayed := receivedEvents(); assert.Equal(t, 1, len(replayed), "Should hold this value") {
+		assert.Equal(t, 2, replayed[0].Vals["n"], "Should hold this value")
+		assert.Equal(t, 3, replayed[0].Replay.Count, "Should be the third replay")
+	}
+}
+
+func TestPersisterRetries(t *testing.T) {
+	persistPath := "test-persister-retries"
+	defer os.RemoveAll(persistPath)
+
+	var (
+		attempts   = make(map[interface{}]int)
+		deadLetter []interface{}
+		mtx        sync.Mutex
+	)
+	run := func(clock events.Clock, opts *PersisterOptions, fail func(n interface{}, attempt int) bool, n int) *events.Pipeline {
+		attempts, deadLetter = make(map[interface{}]int), nil
+		emitter := events.NewEmitterBase("test-emitter", nil)
+		sink := NewFuncSink("test-sink", func(e *events.Event) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			attempts[e.Vals["n"]]++
+			if fail(e.Vals["n"], attempts[e.Vals["n"]]) {
+				return fmt.Errorf("Sink down")
+			}
+			return nil
+		})
+		opts.PersistPath = persistPath
+		opts.MaxEvents = 1
+		opts.Clock = clock
+		opts.DeadLetter = func(e *events.Event) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			deadLetter = append(deadLetter, e.Vals["n"])
+		}
+		persister := NewPersister("test-persister", opts)
+		pipeline := events.NewPipeline(emitter)
+		_, err := pipeline.Plug(emitter, persister)
+		assert.Nil(t, err, "Should be nil")
+		_, err = pipeline.Plug(persister, sink)
+		assert.Nil(t, err, "Should be nil")
+
+		pipeline.Run()
+		for i := 0; i < n; i++ {
+			emitter.Emit("Courage", &events.Vals{"n": i})
+		}
+		time.Sleep(20 * time.Millisecond)
+		return pipeline
+	}
+	committed := func() uint64 {
+		seq, err := LastCommit(persistPath, nil)
+		assert.Nil(t, err, "Should be nil")
+		return seq
+	}
+	advance := func(clock *testClock) {
+		clock.Advance(time.Second)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The third event fails once, and the fifth one every time
+	clock := newTestClock()
+	pipeline := run(clock, &PersisterOptions{DeliveryDeadline: 3 * time.Second}, func(n interface{}, attempt int) bool {
+		return (n == 2 && attempt == 1) || n == 4
+	}, 6)
+	assert.Equal(t, uint64(2), committed(), "Should wait for the failed event")
+
+	clock.WaitForTickers(t)
+	advance(clock)
+	assert.Equal(t, uint64(4), committed(), "The event retried should have been committed")
+	advance(clock)
+	assert.Equal(t, uint64(4), committed(), "Should wait for the failed event")
+	advance(clock)
+	assert.Equal(t, uint64(6), committed(), "Later events should have been committed")
+	mtx.Lock()
+	assert.Equal(t, []interface{}{4}, deadLetter, "The event failing should have been given up on")
+	assert.Equal(t, 3, attempts[4], "Should have been retried until the deadline")
+	mtx.Unlock()
+	pipeline.Stop()
+
+	// The oldest events are given up on when too many are waiting
+	pipeline = run(newTestClock(), &PersisterOptions{MaxPending: 2}, func(n interface{}, attempt int) bool {
+		return true
+	}, 5)
+	assert.Equal(t, uint64(9), committed(), "The oldest events should have been committed")
+	mtx.Lock()
+	assert.Equal(t, []interface{}{0, 1, 2}, deadLetter, "The oldest events should have been given up on")
+	mtx.Unlock()
+	pipeline.Stop()
+}
+
+func TestPersisterMaxPendingAppending(t *testing.T) {
+	persistPath := "test-persister-appending"
+	defer os.RemoveAll(persistPath)
+
+	var deadLetter []*events.Event
+	persister := NewPersister("test-persister", &PersisterOptions{
+		PersistPath: persistPath,
+		MaxPending:  1,
+		DeadLetter: func(e *events.Event) {
+			deadLetter = append(deadLetter, e)
+		},
+	})
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	pipeline := events.NewPipeline(emitter)
+	_, err := pipeline.Plug(persister, NewNullSink("test-sink"))
+	assert.Nil(t, err, "Should be nil")
+	_, err = persister.openJournal()
+	assert.Nil(t, err, "Should be nil")
+
+	// Another inbound wire is still appending the first event
+	appending := events.NewEvent("Patience", &events.Vals{})
+	persister.mtx.Lock()
+	persister.seq++
+	persister.addPending(appending, persister.seq, 1)
+	persister.appending[persister.seq] = persister.journal.Segments()[0]
+	persister.mtx.Unlock()
+
+	assert.Nil(t, persister.persistEvent(events.NewEvent("Patience", &events.Vals{})), "Should be nil")
+	assert.Empty(t, deadLetter, "An event not sent yet shouldn't be given up on")
+
+	// Until it's appended
+	persister.mtx.Lock()
+	delete(persister.appending, 1)
+	persister.mtx.Unlock()
+	assert.Nil(t, persister.persistEvent(events.NewEvent("Patience", &events.Vals{})), "Should be nil")
+	if assert.Equal(t, 2, len(deadLetter), "The oldest events should have been given up on") {
+		assert.True(t, deadLetter[0] == appending, "Should be the oldest event")
+	}
+	assert.Nil(t, persister.journal.Close(), "Should be nil")
+}
+
+func TestPersisterMigration(t *testing.T) {
+	persistPath := "test-persister-migration"
+	defer os.RemoveAll(persistPath)
+
+	// As written by older Persisters, all the events again on every write, the
+	// last one cut short
+	writeOld := func() {
+		var b, file bytes.Buffer
+		enc := gob.NewEncoder(&b)
+		for i := 0; i < 5; i++ {
+			assert.Nil(t, enc.Encode(events.NewEvent("Wisdom", &events.Vals{"n": i})), "Should be nil")
+			file.Write(b.Bytes())
+		}
+		file.Write(b.Bytes()[:10])
+		assert.Nil(t, ioutil.WriteFile(persistPath, file.Bytes(), 0644), "Should be nil")
+	}
+	run := func(plugSink bool) []interface{} {
+		var (
+			received []interface{}
+			mtx      sync.Mutex
+		)
+		emitter := events.NewEmitterBase("test-emitter", nil)
+		persister := NewPersister("test-persister", &PersisterOptions{PersistPath: persistPath})
+		pipeline := events.NewPipeline(emitter)
+		_, err := pipeline.Plug(emitter, persister)
+		assert.Nil(t, err, "Should be nil")
+		if plugSink {
+			sink := NewFuncSink("test-sink", func(e *events.Event) error {
+				mtx.Lock()
+				defer mtx.Unlock()
+				assert.NotNil(t, e.Replay, "Migrated events should be replayed")
+				received = append(received, e.Vals["n"])
+				return nil
+			})
+			_, err = pipeline.Plug(persister, sink)
+			assert.Nil(t, err, "Should be nil")
+		}
+
+		pipeline.Run()
+		time.Sleep(20 * time.Millisecond)
+		pipeline.Stop()
+		mtx.Lock()
+		defer mtx.Unlock()
+		return received
+	}
+
+	writeOld()
+	assert.Equal(t, []interface{}{0, 1, 2, 3, 4}, run(true), "Every event should be replayed once")
+	info, err := os.Stat(persistPath)
+	if assert.Nil(t, err, "Should be nil") {
+		assert.True(t, info.IsDir(), "Should be a journal now")
+	}
+	assert.Empty(t, run(true), "The events should have been committed")
+
+	// With nothing to receive them, the events are committed at once
+	assert.Nil(t, os.RemoveAll(persistPath), "Should be nil")
+	writeOld()
+	run(false)
+	committed, err := LastCommit(persistPath, nil)
+	assert.Nil(t, err, "Should be nil")
+	assert.Equal(t, uint64(5), committed, "The events should have been committed")
+}
+
+func TestPersisterConcurrentEvents(t *testing.T) {
+	persistPath := "test-persister-concurrent"
+	defer os.RemoveAll(persistPath)
+
+	run := func(sinkErr error) *Persister {
+		emitter := events.NewEmitterBase("test-emitter", nil)
+		sink := NewFuncSink("test-sink", func(e *events.Event) error {
+			return sinkErr
+		})
+		persister := NewPersister("test-persister", &PersisterOptions{
+			PersistPath:    persistPath,
+			MaxSegmentSize: 1024,
+			Sync:           journal.SyncAlways,
+		})
+		pipeline := events.NewPipeline(emitter)
+		_, err := pipeline.Plug(emitter, persister)
+		assert.Nil(t, err, "Should be nil")
+		_, err = pipeline.PlugWithOptions(persister, sink, &events.WireOptions{BufferSize: 100})
+		assert.Nil(t, err, "Should be nil")
+
+		pipeline.Run()
+		// Several inbound wires receive at once
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for k := 0; k < 25; k++ {
+					persister.Receive(events.NewEvent("Harmony", &events.Vals{"n": i*25 + k}))
+				}
+			}(i)
+		}
+		wg.Wait()
+		time.Sleep(50 * time.Millisecond)
+		pipeline.Stop()
+		return persister
+	}
+
+	// The events journaled at once are all recovered, once each
+	evts, err := run(fmt.Errorf("Sink down")).recoverEvents()
+	assert.Nil(t, err, "Should be nil")
+	seen := make(map[interface{}]bool)
+	for _, e := range evts {
+		seen[e.Vals["n"]] = true
+	}
+	assert.Equal(t, 100, len(evts), "Every event should have been recovered")
+	assert.Equal(t, 100, len(seen), "Every event should have been recovered once")
+
+	// And committed once delivered
+	run(nil)
+	committed, err := LastCommit(persistPath, nil)
+	assert.Nil(t, err, "Should be nil")
+	assert.Equal(t, uint64(200), committed, "Every event should have been committed")
+	files, _ := filepath.Glob(filepath.Join(persistPath, "*.journal"))
+	assert.Equal(t, 1, len(files), "Committed segments should have been released")
+}
+
+func BenchmarkPersister(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		opts PersisterOptions
+	}{
+		{"Never", PersisterOptions{Sync: journal.SyncNever}},
+		{"Interval10ms", PersisterOptions{Sync: journal.SyncInterval, SyncInterval: 10 * time.Millisecond}},
+		{"Every100", PersisterOptions{Sync: journal.SyncEvery, SyncEvents: 100}},
+		{"Always", PersisterOptions{Sync: journal.SyncAlways}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			persistPath := "bench-persister"
+			defer os.RemoveAll(persistPath)
+
+			opts := bm.opts
+			opts.PersistPath = persistPath
+			emitter := events.NewEmitterBase("bench-emitter", nil)
+			persister := NewPersister("bench-persister", &opts)
+			pipeline := events.NewPipeline(emitter)
+			pipeline.Plug(emitter, persister)
+			pipeline.PlugWithOptions(persister, NewNullSink("bench-sink"), &events.WireOptions{BufferSize: 1000})
+			pipeline.Run()
+
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					persister.Receive(events.NewEvent("Temperance", &events.Vals{"n": 1}))
+				}
+			})
+			b.StopTimer()
+			pipeline.Stop()
+		})
+	}
+}
+
+// Every event is acknowledged by four wires at once, and committed on its own
+func BenchmarkPersisterAcks(b *testing.B) {
+	persistPath := "bench-persister-acks"
+	defer os.RemoveAll(persistPath)
+
+	emitter := events.NewEmitterBase("bench-emitter", nil)
+	persister := NewPersister("bench-persister", &PersisterOptions{
+		PersistPath: persistPath,
+		Sync:        journal.SyncAlways,
+		MaxEvents:   1,
+	})
+	pipeline := events.NewPipeline(emitter)
+	pipeline.Plug(emitter, persister)
+	for i := 0; i < 4; i++ {
+		pipeline.PlugWithOptions(persister, NewNullSink(fmt.Sprintf("bench-sink-%d", i)), &events.WireOptions{BufferSize: 1000})
+	}
+	pipeline.Run()
+
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			persister.Receive(events.NewEvent("Temperance", &events.Vals{"n": 1}))
+		}
+	})
+	for {
+		persister.mtx.Lock()
+		done := persister.committed == persister.seq
+		persister.mtx.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+	pipeline.Stop()
+}
+
+func TestPersisterSegments(t *testing.T) {
+	persistPath := "test-persister-segments"
+	defer os.RemoveAll(persistPath)
+
+	run := func(fail bool, n int) {
+		emitter := events.NewEmitterBase("test-emitter", nil)
+		sink := NewFuncSink("test-sink", func(e *events.Event) error {
+			if fail {
+				return fmt.Errorf("Sink down")
+			}
+			return nil
+		})
+		persister := NewPersister("test-persister", &PersisterOptions{
+			PersistPath: persistPath,
+			// Room for a couple of events per segment
+			MaxSegmentSize: 256,
+			Retention:      journal.ArchiveReleased,
+			MaxArchived:    3,
+		})
+		pipeline := events.NewPipeline(emitter)
+		_, err := pipeline.Plug(emitter, persister)
+		assert.Nil(t, err, "Should be nil")
+		_, err = pipeline.Plug(persister, sink)
+		assert.Nil(t, err, "Should be nil")
+
+		pipeline.Run()
+		for i := 0; i < n; i++ {
+			emitter.Emit("Patience", &events.Vals{"n": i})
+		}
+		time.Sleep(20 * time.Millisecond)
+		pipeline.Stop()
+	}
+	segments := func(dir string) int {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.journal"))
+		return len(files)
+	}
+
+	// Nothing is committed, so every segment is kept
+	run(true, 10)
+	assert.True(t, segments(persistPath) > 3, "The journal should have been split in segments")
+
+	// Once everything is committed, only the segment being written is left
+	run(false, 10)
+	assert.Equal(t, 1, segments(persistPath), "Committed segments should have been released")
+	assert.Equal(t, 3, segments(filepath.Join(persistPath, "archive")), "Only some segments should be archived")
+}
+
+func TestPersisterCompression(t *testing.T) {
+	persistPath := "test-persister-compression"
+	defer os.RemoveAll(persistPath)
+
+	run := func(codec journal.Codec, sinkFn func(e *events.Event) error, from, to int) {
+		emitter := events.NewEmitterBase("test-emitter", nil)
+		sink := NewFuncSink("test-sink", sinkFn)
+		persister := NewPersister("test-persister", &PersisterOptions{PersistPath: persistPath, Codec: codec})
+		pipeline := events.NewPipeline(emitter)
+		_, err := pipeline.Plug(emitter, persister)
+		assert.Nil(t, err, "Should be nil")
+		_, err = pipeline.Plug(persister, sink)
+		assert.Nil(t, err, "Should be nil")
+
+		pipeline.Run()
+		for i := from; i < to; i++ {
+			emitter.Emit("Temperance", &events.Vals{"n": i})
+		}
+		time.Sleep(20 * time.Millisecond)
+		pipeline.Stop()
+	}
+	down := func(e *events.Event) error {
+		return fmt.Errorf("Sink down")
+	}
+
+	// Nothing is delivered, with and without compression
+	run(nil, down, 0, 2)
+	run(journal.Gzip, down, 2, 4)
+
+	var replayed []interface{}
+	run(nil, func(e *events.Event) error {
+		replayed = append(replayed, e.Vals["n"])
+		return nil
+	}, 0, 0)
+	assert.Equal(t, []interface{}{0, 1, 2, 3}, replayed, "Every event should be replayed from the mixed journal")
+}
+
+func TestPersisterEncryption(t *testing.T) {
+	persistPath := "test-persister-encryption"
+	defer os.RemoveAll(persistPath)
+
+	keys := &journal.StaticKeys{Current: "k1", Keys: map[string][]byte{
+		"k1": []byte("0123456789abcdef0123456789abcdef"),
+	}}
+	run := func(sinkFn func(e *events.Event) error, from, to int) {
+		emitter := events.NewEmitterBase("test-emitter", nil)
+		sink := NewFuncSink("test-sink", sinkFn)
+		persister := NewPersister("test-persister", &PersisterOptions{PersistPath: persistPath, Keys: keys})
+		pipeline := events.NewPipeline(emitter)
+		_, err := pipeline.Plug(emitter, persister)
+		assert.Nil(t, err, "Should be nil")
+		_, err = pipeline.Plug(persister, sink)
+		assert.Nil(t, err, "Should be nil")
+
+		pipeline.Run()
+		for i := from; i < to; i++ {
+			emitter.Emit("Charity", &events.Vals{"n": i})
+		}
+		time.Sleep(20 * time.Millisecond)
+		pipeline.Stop()
+	}
+	var delivered []interface{}
+	deliver := func(e *events.Event) error {
+		delivered = append(delivered, e.Vals["n"])
+		return nil
+	}
+
+	run(func(e *events.Event) error {
+		return fmt.Errorf("Sink down")
+	}, 0, 2)
+	run(deliver, 2, 2)
+	assert.Equal(t, []interface{}{0, 1}, delivered, "The encrypted events should be replayed")
+
+	// Nothing is replayed from a journal with a key that isn't known, and no more
+	// events are journaled, but they still go through
+	keys.Current = "k2"
+	keys.Keys = map[string][]byte{"k2": []byte("fedcba9876543210")}
+	delivered = nil
+	segments, _ := filepath.Glob(filepath.Join(persistPath, "*.journal"))
+	run(deliver, 2, 3)
+	assert.Equal(t, []interface{}{2}, delivered, "Only the new event should be delivered")
+	after, _ := filepath.Glob(filepath.Join(persistPath, "*.journal"))
+	assert.Equal(t, segments, after, "The journal should have been left alone")
+}
+
+func TestPersisterDiskLimits(t *testing.T) {
+	persistPath := "test-persister-disk"
+	defer os.RemoveAll(persistPath)
+
+	type result struct {
+		delivered []*events.Event
+		// Before stopping the pipeline
+		deliveredRunning int
+		statuses         []interface{}
+		// Of the journal
+		size int64
+	}
+	run := func(opts *PersisterOptions, sinkFn func(e *events.Event) error, n int) *result {
+		r := &result{}
+		var mtx sync.Mutex
+		emitter := events.NewEmitterBase("test-emitter", nil)
+		sink := NewFuncSink("test-sink", func(e *events.Event) error {
+			mtx.Lock()
+			r.delivered = append(r.delivered, e)
+			mtx.Unlock()
+			return sinkFn(e)
+		})
+		opts.PersistPath = persistPath
+		opts.MaxSegmentSize = 1024
+		// Segments are released as soon as their events are delivered
+		opts.MaxEvents = 1
+		persister := NewPersister("test-persister", opts)
+		pipeline := events.NewPipeline(emitter)
+		_, err := pipeline.Plug(emitter, persister)
+		assert.Nil(t, err, "Should be nil")
+		_, err = pipeline.PlugWithOptions(persister, sink, &events.WireOptions{BufferSize: 100})
+		assert.Nil(t, err, "Should be nil")
+		// Status events go to every receiver
+		_, err = pipeline.Plug(persister, &statusRecorder{SinkBase: events.NewSinkBase("test-status-sink"), statuses: &r.statuses, mtx: &mtx})
+		assert.Nil(t, err, "Should be nil")
+
+		pipeline.Run()
+		go func() {
+			for i := 0; i < n; i++ {
+				emitter.Emit("Diligence", &events.Vals{"n": i})
+			}
+		}()
+		time.Sleep(100 * time.Millisecond)
+		mtx.Lock()
+		deliveredRunning := len(r.delivered)
+		mtx.Unlock()
+		pipeline.Stop()
+		files, _ := filepath.Glob(filepath.Join(persistPath, "*.journal"))
+		size := int64(0)
+		for _, f := range files {
+			info, _ := os.Stat(f)
+			size += info.Size()
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		return &result{
+			delivered:        append([]*events.Event(nil), r.delivered...),
+			deliveredRunning: deliveredRunning,
+			statuses:         append([]interface{}(nil), r.statuses...),
+			size:             size,
+		}
+	}
+	down := func(e *events.Event) error {
+		return fmt.Errorf("Sink down")
+	}
+	nonDurable := func(evs []*events.Event) []interface{} {
+		var ns []interface{}
+		for _, e := range evs {
+			if e.Vals[PersisterNonDurableVal] == true {
+				ns = append(ns, e.Vals["n"])
+			}
+		}
+		return ns
+	}
+
+	// The last events aren't journaled
+	r := run(&PersisterOptions{MaxDiskUsage: 3000}, down, 20)
+	assert.Equal(t, 20, len(r.delivered), "Every event should be delivered")
+	ns := nonDurable(r.delivered)
+	if assert.NotEmpty(t, ns, "Some events should not be durable") {
+		assert.Equal(t, 19, ns[len(ns)-1], "The last events should not be durable")
+	}
+	assert.Equal(t, []interface{}{"quota_exceeded"}, r.statuses, "The status change should be reported")
+	os.RemoveAll(persistPath)
+
+	// No file system has this much room
+	r = run(&PersisterOptions{MinFreeSpace: 1 << 62}, down, 2)
+	assert.Equal(t, []interface{}{0, 1}, nonDurable(r.delivered), "No event should be durable")
+	assert.Equal(t, []interface{}{"low_space"}, r.statuses, "The status change should be reported")
+	os.RemoveAll(persistPath)
+
+	// The first events are evicted
+	r = run(&PersisterOptions{MaxDiskUsage: 3000, DiskPolicy: EvictOldest}, down, 20)
+	assert.Empty(t, nonDurable(r.delivered), "Every event should be journaled")
+	assert.True(t, r.size <= 3000+1024, "Old segments should have been evicted")
+	r = run(&PersisterOptions{}, func(e *events.Event) error { return nil }, 0)
+	if assert.NotEmpty(t, r.delivered, "Should hold this value") {
+		assert.True(t, r.delivered[0].Vals["n"].(int) > 0, "The first events should not be replayed")
+		assert.Equal(t, 19, r.delivered[len(r.delivered)-1].Vals["n"], "Should hold this value")
+	}
+	os.RemoveAll(persistPath)
+
+	// The events wait for the slow sink to catch up
+	gate := make(chan struct{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(gate)
+	}()
+	r = run(&PersisterOptions{MaxDiskUsage: 3000, DiskPolicy: ApplyBackpressure, DiskCheckInterval: time.Millisecond}, func(e *events.Event) error {
+		<-gate
+		return nil
+	}, 20)
+	assert.Equal(t, 20, r.deliveredRunning, "Every event should be delivered once there's room")
+	assert.Empty(t, nonDurable(r.delivered), "Every event should be journaled")
+	if assert.NotEmpty(t, r.statuses, "The status changes should be reported") {
+		for i, status := range r.statuses {
+			assert.Equal(t, []string{"quota_exceeded", "ok"}[i%2], status, "Should hold this value")
+		}
+		assert.Equal(t, "ok", r.statuses[len(r.statuses)-1], "There should be room in the end")
+	}
+	os.RemoveAll(persistPath)
+
+	// Without room, the events stop waiting
+	r = run(&PersisterOptions{MaxDiskUsage: 3000, DiskPolicy: ApplyBackpressure, DiskCheckInterval: time.Millisecond, MaxBackpressure: 20 * time.Millisecond}, down, 20)
+	assert.Equal(t, 20, r.deliveredRunning, "Every event should be delivered")
+	ns = nonDurable(r.delivered)
+	if assert.NotEmpty(t, ns, "Some events should not be durable") {
+		assert.Equal(t, 19, ns[len(ns)-1], "The last events should not be durable")
+	}
+}
+
+func TestCompactJournal(t *testing.T) {
+	persistPath := "test-persister-compact"
+	defer os.RemoveAll(persistPath)
+
+	j, err := journal.Open(&journal.Options{Dir: persistPath, MaxSegmentSize: 256})
+	if err != nil {
+		t.Fatalf("Error opening journal: %v", err)
+	}
+	appendRecord := func(r *JournalRecord) {
+		b, err := r.Encode()
+		assert.Nil(t, err, "Should be nil")
+		_, err = j.Append(b)
+		assert.Nil(t, err, "Should be nil")
+	}
+	for i := 1; i <= 5; i++ {
+		appendRecord(&JournalRecord{Type: JournalEvent, Seq: uint64(i), Event: events.NewEvent("Patience", &events.Vals{"n": i})})
+		if i == 3 {
+			appendRecord(&JournalRecord{Type: JournalCommit, Seq: 3})
+		}
+	}
+	assert.Nil(t, j.Close(), "Should be nil")
+
+	kept, err := CompactJournal(persistPath, nil)
+	assert.Nil(t, err, "Should be nil")
+	assert.Equal(t, 3, kept, "The events not committed and the last commit should be kept")
+
+	committed, err := LastCommit(persistPath, nil)
+	assert.Nil(t, err, "Should be nil")
+	assert.Equal(t, uint64(3), committed, "Should hold this value")
+
+	p := NewPersister("test-persister", &PersisterOptions{PersistPath: persistPath})
+	recovered, err := p.recoverEvents()
+	assert.Nil(t, err, "Should be nil")
+	if assert.Equal(t, 2, len(recovered), "Should hold this value") {
+		assert.Equal(t, 4, recovered[0].Vals["n"], "Should hold this value")
+	}
+	assert.Equal(t, uint64(5), p.seq, "Sequence numbers should go on from the compacted journal")
+}
+
+func TestKeyedState(t *testing.T) {
+	statePath := "test-keyed-state"
+	defer os.Remove(statePath)
+
+	clock := newTestClock()
+	backend, err := NewFileStateBackend(statePath)
+	if err != nil {
+		t.Fatalf("Error creating file state backend: %v", err)
+	}
+	state, err := NewKeyedState(&KeyedStateOptions{
+		TTL:     time.Minute,
+		Backend: backend,
+		Clock:   clock,
+	})
+	if err != nil {
+		t.Fatalf("Error creating keyed state: %v", err)
+	}
+
+	assert.Nil(t, state.Put("Patience", 1), "Should be nil")
+	assert.Nil(t, state.Put("Kindness", "infinite"), "Should be nil")
+	for i := 0; i < 3; i++ {
+		err := state.Update("Patience", func(v interface{}, ok bool) interface{} {
+			return v.(int) + 1
+		})
+		assert.Nil(t, err, "Should be nil")
+	}
+	v, ok := state.Get("Patience")
+	assert.True(t, ok, "The key should be present")
+	assert.Equal(t, 4, v, "Should hold this value")
+	assert.Equal(t, 2, state.Len(), "Both keys should be present")
+	assert.True(t, state.Bytes() > 0, "Memory usage should be accounted")
+
+	// Entries not updated within the TTL expire
+	clock.Advance(45 * time.Second)
+	assert.Nil(t, state.Put("Patience", 5), "Should be nil")
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, 1, state.Expire(), "Only one key should have expired")
+	_, ok = state.Get("Kindness")
+	assert.False(t, ok, "The key should have expired")
+
+	// A new state over the same file recovers the entries
+	assert.Nil(t, state.Close(), "Should be nil")
+	backend, err = NewFileStateBackend(statePath)
+	if err != nil {
+		t.Fatalf("Error reopening file state backend: %v", err)
+	}
+	state, err = NewKeyedState(&KeyedStateOptions{
+		TTL:     time.Minute,
+		Backend: backend,
+		Clock:   clock,
+	})
+	if err != nil {
+		t.Fatalf("Error recreating keyed state: %v", err)
+	}
+	v, ok = state.Get("Patience")
+	assert.True(t, ok, "The key should have been recovered")
+	assert.Equal(t, 5, v, "Should hold this value")
+	assert.Equal(t, 1, state.Len(), "Expired keys should not be recovered")
+
+	drained := make(map[events.Key]interface{})
+	assert.Nil(t, state.Drain(func(k events.Key, v interface{}) { drained[k] = v }), "Should be nil")
+	assert.Equal(t, 1, len(drained), "The entry should have been drained")
+	assert.Equal(t, 0, state.Len(), "The state should be empty")
+	assert.Nil(t, state.Close(), "Should be nil")
+
+	// Memory limits are enforced
+	state, err = NewKeyedState(&KeyedStateOptions{MaxBytes: 2 * stateEntryOverhead})
+	if err != nil {
+		t.Fatalf("Error creating keyed state: %v", err)
+	}
+	assert.Nil(t, state.Put("A", 1), "Should be nil")
+	assert.Equal(t, ErrStateFull, state.Put("B", "a string long enough to go over the limit"), "The state should be full")
+}
+
+func TestWindowedAggregator(t *testing.T) {
+	evs := make(chan *events.Event, 10)
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	sink := NewCallbackSink("test-sink", func(e *events.Event) {
+		log.Tracef("Entering callback with event %v", e)
+		evs <- e
+	})
+
+	tumbling := NewWindowedAggregator(
+		"test-tumbling",
+		&WindowOptions{
+			Type:       TumblingWindow,
+			Time:       EventTime,
+			Size:       time.Minute,
+			Directives: []AggregationDirectiveOptions{{}, {GroupBy: []string{"country"}}},
+		},
+		AggregationDirective{Key: "Karma", Val: "level", AggregatorFunc: AggregatorIntRunningSum, Identity: RunningSumIdentity},
+		AggregationDirective{Key: "Wisdom", Val: "level", AggregatorFunc: AggregatorIntRunningSum, Identity: RunningSumIdentity},
+	)
+	sliding := NewWindowedAggregator(
+		"test-sliding",
+		&WindowOptions{Type: SlidingWindow, Time: EventTime, Size: time.Minute, Hop: 30 * time.Second},
+		AggregationDirective{Key: "Happiness", Val: "level", AggregatorFunc: AggregatorIntRunningSum, Identity: RunningSumIdentity},
+	)
+	session := NewWindowedAggregator(
+		"test-session",
+		&WindowOptions{Type: SessionWindow, Time: EventTime, Gap: 10 * time.Second},
+		AggregationDirective{Key: "Serenity", Val: "level", AggregatorFunc: AggregatorIntRunningSum, Identity: RunningSumIdentity},
+	)
+
+	pipeline := events.NewPipeline(emitter)
+	_, err := pipeline.Plug(emitter, tumbling)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(tumbling, sliding)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(sliding, session)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(session, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+
+	base := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	sendVals := func(k events.Key, vals events.Vals, offset time.Duration) {
+		evt := events.NewEvent(k, &vals)
+		evt.Timestamp = base.Add(offset)
+		emitter.Send(evt)
+	}
+	send := func(k events.Key, level int, offset time.Duration) {
+		evt := events.NewEvent(k, &events.Vals{"level": level})
+		evt.Timestamp = base.Add(offset)
+		emitter.Send(evt)
+	}
+
+	// Tumbling windows
+	send("Karma", 1, 10*time.Second)
+	send("Karma", 2, 50*time.Second)
+	send("Karma", 4, 70*time.Second)
+	e := <-evs
+	assert.Equal(t, 3, e.Vals["level"], "Should hold the sum of the first window")
+	assert.Equal(t, base, e.Vals[WindowStartVal], "Should hold the window start")
+	assert.Equal(t, base.Add(time.Minute), e.Vals[WindowEndVal], "Should hold the window end")
+
+	// Late events are discarded
+	send("Karma", 8, 20*time.Second)
+	send("Karma", 16, 130*time.Second)
+	e = <-evs
+	assert.Equal(t, 4, e.Vals["level"], "Should hold the sum of the second window")
+
+	// Grouped tumbling windows
+	sendVals("Wisdom", events.Vals{"level": 1, "country": "ES"}, 130*time.Second)
+	sendVals("Wisdom", events.Vals{"level": 2, "country": "IR"}, 140*time.Second)
+	sendVals("Wisdom", events.Vals{"level": 4, "country": "ES"}, 150*time.Second)
+	sendVals("Wisdom", events.Vals{"level": 8, "country": "ES"}, 190*time.Second)
+	sums := make(map[interface{}]interface{})
+	for i := 0; i < 3; i++ {
+		e = <-evs
+		if e.Key == "Wisdom" {
+			sums[e.Vals["country"]] = e.Vals["level"]
+		}
+	}
+	assert.Equal(t, map[interface{}]interface{}{"ES": 5, "IR": 2}, sums, "Each group should be aggregated separately")
+
+	// Sliding windows: [-30s, 30s) [0s, 60s) [30s, 90s) [60s, 120s)...
+	send("Happiness", 1, 20*time.Second)
+	send("Happiness", 2, 40*time.Second)
+	send("Happiness", 4, 100*time.Second)
+	e = <-evs
+	assert.Equal(t, 1, e.Vals["level"], "Should hold the sum of the window [-30s, 30s)")
+	e = <-evs
+	assert.Equal(t, 3, e.Vals["level"], "Should hold the sum of the window [0s, 60s)")
+	e = <-evs
+	assert.Equal(t, 2, e.Vals["level"], "Should hold the sum of the window [30s, 90s)")
+
+	// Session windows
+	send("Serenity", 1, 0)
+	send("Serenity", 2, 5*time.Second)
+	send("Serenity", 4, 12*time.Second)
+	send("Serenity", 8, 30*time.Second)
+	e = <-evs
+	assert.Equal(t, 7, e.Vals["level"], "Should hold the sum of the first session")
+	assert.Equal(t, base, e.Vals[WindowStartVal], "Should hold the session start")
+	assert.Equal(t, base.Add(22*time.Second), e.Vals[WindowEndVal], "Should hold the session end")
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, len(evs), "No other window should have been closed")
+
+	pipeline.Stop()
+}
+
+func TestAggregatorFunctions(t *testing.T) {
+	aggregate := func(f func(accum, x interface{}) (interface{}, interface{}), xs ...interface{}) (interface{}, interface{}) {
+		var accum, x2 interface{}
+		for _, x := range xs {
+			accum, x2 = f(accum, x)
+		}
+		return accum, x2
+	}
+
+	_, v := aggregate(AggregatorCount, 3, 1, 2)
+	assert.Equal(t, int64(3), v, "Should count the values")
+	_, v = aggregate(AggregatorMin, 3, 1.5, 2)
+	assert.Equal(t, 1.5, v, "Should hold the minimum")
+	_, v = aggregate(AggregatorMax, 3, 1.5, int64(4))
+	assert.Equal(t, 4.0, v, "Should hold the maximum")
+	_, v = aggregate(AggregatorVariance, 2, 4, 4, 4, 5, 5, 7, 9)
+	assert.Equal(t, 4.0, v, "Should hold the variance")
+	_, v = aggregate(AggregatorStdDev, 2, 4, 4, 4, 5, 5, 7, 9)
+	assert.Equal(t, 2.0, v, "Should hold the standard deviation")
+
+	// With a half-life of one value, each value weighs twice as much as the previous one
+	_, v = aggregate(NewAggregatorEWMA(1), 1.0, 4.0)
+	assert.InDelta(t, 3.0, v, 1e-9, "Should hold the weighted average")
+
+	xs := make([]interface{}, 1000)
+	for i := range xs {
+		xs[i] = i + 1
+	}
+	_, v = aggregate(NewAggregatorQuantile(0.5), xs...)
+	assert.InEpsilon(t, 500.0, v, DefaultQuantileAccuracy*2, "Should approximate the median")
+	_, v = aggregate(NewAggregatorQuantile(0.99), xs...)
+	assert.InEpsilon(t, 990.0, v, DefaultQuantileAccuracy*2, "Should approximate the 99th percentile")
+
+	for i := range xs {
+		xs[i] = fmt.Sprintf("device-%d", i%500)
+	}
+	_, v = aggregate(AggregatorDistinctCount, xs...)
+	assert.InEpsilon(t, 500.0, float64(v.(int64)), 0.05, "Should approximate the distinct count")
+
+	// Merging states gives the same results as aggregating everything together
+	a, _ := aggregate(AggregatorStdDev, 2, 4, 4, 4)
+	b, _ := aggregate(AggregatorStdDev, 5, 5, 7, 9)
+	merged, err := MergeStates(a, b)
+	assert.Nil(t, err, "Should be nil")
+	assert.Equal(t, 2.0, merged.(*MomentsState).StdDev(), "Should hold the standard deviation")
+	assert.Equal(t, int64(4), a.(*MomentsState).N, "The states merged should be left untouched")
+	assert.Equal(t, int64(4), b.(*MomentsState).N, "The states merged should be left untouched")
+
+	a, _ = aggregate(AggregatorDistinctCount, "a", "b", "c")
+	b, _ = aggregate(AggregatorDistinctCount, "b", "c", "d")
+	merged, err = MergeStates(a, b)
+	assert.Nil(t, err, "Should be nil")
+	assert.Equal(t, int64(4), merged.(MergeableState).Value(), "Should hold the distinct count")
+	assert.Equal(t, int64(3), a.(MergeableState).Value(), "The states merged should be left untouched")
+	merged, err = MergeStates(nil, b)
+	assert.Nil(t, err, "Should be nil")
+	merged.(*DistinctState).add("e")
+	assert.Equal(t, int64(3), b.(MergeableState).Value(), "The state merged with nothing should be copied")
+
+	a, _ = AggregatorFloat64MovingAverage(MovingAverageIdentity, 1.0)
+	a, _ = AggregatorFloat64MovingAverage(a, 2.0)
+	b, _ = AggregatorFloat64MovingAverage(MovingAverageIdentity, 6.0)
+	merged, err = MergeStates(a, b)
+	assert.Nil(t, err, "Should be nil")
+	assert.Equal(t, []float64{3, 3}, merged, "Should hold the count and the average")
+
+	_, err = MergeStates(a, &CountState{})
+	assert.NotNil(t, err, "Should not merge different states")
+}
+
+func TestAggregatorSummariesGroupBy(t *testing.T) {
+	evs := make(chan *events.Event, 10)
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	sink := NewCallbackSink("test-sink", func(e *events.Event) {
+		evs <- e
+	})
+
+	aggregator := NewAggregatorWithOptions(
+		"test-aggregator",
+		&AggregatorOptions{
+			Mode:           AggregatorSummarize,
+			DropAggregated: true,
+			Directives: []AggregationDirectiveOptions{
+				{Output: "by_country", GroupBy: []string{"country"}},
+				{Output: "by_region", GroupBy: []string{"region"}},
+			},
+		},
+		AggregationDirective{Key: "Karma", Val: "level", AggregatorFunc: AggregatorIntRunningSum, Identity: RunningSumIdentity},
+		AggregationDirective{Key: "Karma", Val: "level", AggregatorFunc: AggregatorIntRunningSum, Identity: RunningSumIdentity},
+	)
+
+	pipeline := events.NewPipeline(emitter)
+	_, err := pipeline.Plug(emitter, aggregator)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(aggregator, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+
+	// Groups of different fields with the same values don't share summaries
+	emitter.Emit("Karma", &events.Vals{"level": 10, "country": "ES", "region": "ES"})
+	emitter.Emit("Karma", &events.Vals{"level": 5, "country": "FR", "region": "ES"})
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, aggregator.Summarize(), "Should be nil")
+	var sums []events.Vals
+	for i := 0; i < 3; i++ {
+		select {
+		case e := <-evs:
+			sums = append(sums, e.Vals)
+		case <-time.After(time.Second):
+			t.Fatalf("Only %v summaries reached the sink", i)
+		}
+	}
+	assert.Contains(t, sums, events.Vals{"country": "ES", "by_country": 10}, "Should hold the sum of the country")
+	assert.Contains(t, sums, events.Vals{"country": "FR", "by_country": 5}, "Should hold the sum of the country")
+	assert.Contains(t, sums, events.Vals{"region": "ES", "by_region": 15}, "Should hold the sum of the region")
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, len(evs), "No other events should have arrived to the sink")
+
+	pipeline.Stop()
+}
+
+func TestAggregatorSummaries(t *testing.T) {
+	evs := make(chan *events.Event, 10)
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	sink := NewCallbackSink("test-sink", func(e *events.Event) {
+		log.Tracef("Entering callback with event %v", e)
+		evs <- e
+	})
+
+	aggregator := NewAggregatorWithOptions(
+		"test-aggregator",
+		&AggregatorOptions{
+			Mode:            AggregatorSummarize,
+			DropAggregated:  true,
+			SummarizeOnMark: true,
+			Directives:      []AggregationDirectiveOptions{{GroupBy: []string{"country"}}},
+		},
+		AggregationDirective{Key: "Karma", Val: "level", AggregatorFunc: AggregatorIntRunningSum, Identity: RunningSumIdentity},
+	)
+
+	pipeline := events.NewPipeline(emitter)
+	_, err := pipeline.Plug(emitter, aggregator)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(aggregator, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+
+	emitter.Emit("Karma", &events.Vals{"level": 20, "country": "ES"})
+	emitter.Emit("Karma", &events.Vals{"level": 10, "country": "ES"})
+	emitter.Emit("Karma", &events.Vals{"level": 5, "country": "IR"})
+	emitter.Emit("Wisdom", &events.Vals{"level": 1})
+	e := <-evs
+	assert.Equal(t, events.Key("Wisdom"), e.Key, "Only events not aggregated should pass through")
+	assert.Equal(t, 1, e.Vals["level"], "Should hold this value")
+
+	// Summaries on demand
+	assert.Nil(t, aggregator.Summarize(), "Should be nil")
+	sums := make(map[interface{}]interface{})
+	for i := 0; i < 2; i++ {
+		e = <-evs
+		assert.Equal(t, events.Key("Karma"+SummaryKeySuffix), e.Key, "Should be a summary event")
+		sums[e.Vals["country"]] = e.Vals["level"]
+	}
+	assert.Equal(t, map[interface{}]interface{}{"ES": 30, "IR": 5}, sums, "Should hold the sums per group")
+
+	// Summaries on mark, with the aggregation restarted
+	emitter.Emit("Karma", &events.Vals{"level": 7, "country": "ES"})
+	emitter.Send(events.NewEvent("", &events.Vals{string(events.SystemEventMark): nil}))
+	e = <-evs
+	assert.Equal(t, 7, e.Vals["level"], "The aggregation should have been restarted")
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, len(evs), "No other events should have arrived to the sink")
+
+	pipeline.Stop()
+}
+
+func TestAggregatorSummariesInterval(t *testing.T) {
+	evs := make(chan *events.Event, 10)
+
+	emitter := events.NewEmitterBase("test-emitter", nil)
+	sink := NewCallbackSink("test-sink", func(e *events.Event) {
+		evs <- e
+	})
+
+	aggregator := NewAggregatorWithOptions(
+		"test-aggregator",
+		&AggregatorOptions{
+			Mode:           AggregatorSummarize,
+			DropAggregated: true,
+			Interval:       time.Minute,
+			Directives:     []AggregationDirectiveOptions{{GroupBy: []string{"country"}}},
+		},
+		AggregationDirective{Key: "Karma", Val: "level", AggregatorFunc: AggregatorIntRunningSum, Identity: RunningSumIdentity},
+	)
+
+	clock := newTestClock()
+	pipeline := events.NewPipeline(emitter)
+	pipeline.SetClock(clock)
+	_, err := pipeline.Plug(emitter, aggregator)
+	assert.Nil(t, err, "Should be nil")
+	_, err = pipeline.Plug(aggregator, sink)
+	assert.Nil(t, err, "Should be nil")
+
+	pipeline.Run()
+	clock.WaitForTickers(t)
+
+	next := func() *events.Event {
+		select {
+		case e := <-evs:
+			return e
+		case <-time.After(time.Second):
+			t.Fatalf("No event reached the sink")
+			return nil
+		}
+	}
+
+	// The event not aggregated tells the others have been
+	emitter.Emit("Karma", &events.Vals{"level": 20, "country": "ES"})
+	emitter.Emit("Karma", &events.Vals{"level": 10, "country": "ES"})
+	emitter.Emit("Wisdom", &events.Vals{"level": 1})
+	assert.Equal(t, events.Key("Wisdom"), next().Key, "Only events not aggregated should pass through")
+	clock.Advance(time.Minute)
+	e := next()
+	assert.Equal(t, events.Key("Karma"+SummaryKeySuffix), e.Key, "Should be a summary event")
+	assert.Equal(t, 30, e.Vals["level"], "Should hold the sum of the interval")
+
+	// Every interval, with the aggregation restarted
+	emitter.Emit("Karma", &events.Vals{"level": 5, "country": "ES"})
+	emitter.Emit("Wisdom", &events.Vals{"level": 1})
+	assert.Equal(t, events.Key("Wisdom"), next().Key, "Only events not aggregated should pass through")
+	clock.Advance(time.Minute)
+	e = next()
+	assert.Equal(t, events.Key("Karma"+SummaryKeySuffix), e.Key, "Should be a summary event")
+	assert.Equal(t, 5, e.Vals["level"], "The aggregation should have been restarted")
 
+	// No summaries after the pipeline stops
 	pipeline.Stop()
+	clock.WaitForTickersStopped(t)
+	assert.Equal(t, 0, len(evs), "No other events should have arrived to the sink")
 }
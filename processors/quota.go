@@ -0,0 +1,257 @@
+// A quota processor lets through up to Limit events of each key per calendar
+// period (i.e. per day), and applies the OverQuotaPolicy to the rest. The
+// counters are kept in a file, so restarting the process doesn't reset them.
+// The file grows with every event, and is compacted when a period starts, with
+// the counters of the periods past dropped, and every CheckpointEvery events.
+// Periods start at the calendar boundaries of the chosen time zone: on the hour,
+// at midnight, on Mondays at midnight, or on the first day of the month.
+
+package processors
+
+import (
+	"encoding/gob"
+	"sync"
+	"time"
+
+	events "github.com/getlantern/events-pipeline"
+)
+
+type QuotaPeriod int
+
+const (
+	QuotaDaily QuotaPeriod = iota
+	QuotaHourly
+	QuotaWeekly
+	QuotaMonthly
+)
+
+type OverQuotaPolicy int
+
+const (
+	// Discard the events over quota
+	DropOverQuota OverQuotaPolicy = iota
+	// Let the events through, with the OverQuotaField set to true
+	TagOverQuota
+)
+
+// Default field set by TagOverQuota
+const OverQuotaVal = "over_quota"
+
+type QuotaOptions struct {
+	// Events per key and period
+	Limit  int64
+	Period QuotaPeriod
+	// Time zone of the period boundaries. Defaults to UTC.
+	Location *time.Location
+	Policy   OverQuotaPolicy
+	// Defaults to OverQuotaVal
+	OverQuotaField string
+	// File where the counters are stored
+	StatePath string
+	// Events between compactions of the file. Defaults to 10000.
+	CheckpointEvery int
+	// Defaults to the pipeline clock
+	Clock events.Clock
+}
+
+// start returns the beginning of the period t falls in
+func (o *QuotaOptions) start(t time.Time) time.Time {
+	t = t.In(o.Location)
+	y, m, d := t.Date()
+	switch o.Period {
+	case QuotaHourly:
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, o.Location)
+	case QuotaWeekly:
+		// Weeks start on Monday
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, o.Location)
+	case QuotaMonthly:
+		return time.Date(y, m, 1, 0, 0, 0, 0, o.Location)
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, o.Location)
+}
+
+// maxLength is the longest a period can be, with daylight saving time changes
+func (o *QuotaOptions) maxLength() time.Duration {
+	switch o.Period {
+	case QuotaHourly:
+		return 2 * time.Hour
+	case QuotaWeekly:
+		return 7*24*time.Hour + time.Hour
+	case QuotaMonthly:
+		return 31*24*time.Hour + time.Hour
+	}
+	return 25 * time.Hour
+}
+
+type quotaCounter struct {
+	Start time.Time
+	Count int64
+}
+
+func init() {
+	gob.Register(&quotaCounter{})
+}
+
+type QuotaProcessor struct {
+	*events.ProcessorBase
+	options *QuotaOptions
+	clock   *switchableClock
+
+	counters *KeyedState
+	// Current period, and events counted since the last checkpoint
+	period  time.Time
+	updates int
+	mtx     sync.Mutex
+}
+
+func NewQuotaProcessor(id string, opts *QuotaOptions) *QuotaProcessor {
+	if opts.Limit == 0 {
+		panic("A quota of 0 events per period makes no sense")
+	}
+	if opts.StatePath == "" {
+		panic("QuotaOptions MUST include StatePath")
+	}
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	if opts.OverQuotaField == "" {
+		opts.OverQuotaField = OverQuotaVal
+	}
+	if opts.CheckpointEvery == 0 {
+		opts.CheckpointEvery = 10000
+	}
+
+	clock := &switchableClock{opts.Clock}
+	if opts.Clock == nil {
+		clock.Clock = events.SystemClock
+	}
+
+	backend, err := NewFileStateBackend(opts.StatePath)
+	if err != nil {
+		panic(err)
+	}
+	// A counter not updated for a whole period is from a past one
+	counters, err := NewKeyedState(&KeyedStateOptions{
+		TTL:     opts.maxLength(),
+		Backend: backend,
+		Clock:   clock,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return &QuotaProcessor{
+		ProcessorBase: events.NewProcessorBase(id, nil),
+		options:       opts,
+		clock:         clock,
+		counters:      counters,
+	}
+}
+
+func (q *QuotaProcessor) SetClock(c events.Clock) {
+	if q.options.Clock == nil {
+		q.clock.Clock = c
+	}
+}
+
+func (q *QuotaProcessor) Receive(evt *events.Event) error {
+	log.Tracef("QUOTA ID %v PROCESSED event: %v with: %v", q.ID(), evt.Key, evt.Vals)
+
+	// Handle the SystemEvent signals
+	if evt.Key == "" {
+		if _, ok := evt.Vals[string(events.SystemEventStop)]; ok {
+			if err := q.counters.Checkpoint(); err != nil {
+				log.Errorf("Error checkpointing quota counters: %v", err)
+			}
+			if err := q.counters.Close(); err != nil {
+				log.Errorf("Error closing quota counters: %v", err)
+			}
+		}
+		return nil
+	}
+
+	err := q.ProcessorBase.Receive(evt)
+	if err != nil {
+		return err
+	}
+
+	start := q.options.start(q.clock.Now())
+	var count int64
+	err = q.counters.Update(evt.Key, func(v interface{}, ok bool) interface{} {
+		// Counters are replaced rather than modified, as Used reads them unlocked
+		count = 1
+		if c, _ := v.(*quotaCounter); ok && c.Start.Equal(start) {
+			count = c.Count + 1
+		}
+		return &quotaCounter{Start: start, Count: count}
+	})
+	if err != nil {
+		return err
+	}
+	q.checkpoint(start)
+
+	if count <= q.options.Limit {
+		return q.ProcessorBase.Send(evt)
+	}
+	if q.options.Policy == TagOverQuota {
+		return q.ProcessorBase.Send(copyEvent(evt, events.Vals{q.options.OverQuotaField: true}))
+	}
+	return nil
+}
+
+// checkpoint compacts the file of the counters when a period starts, dropping
+// the ones of the past periods, or every CheckpointEvery events
+func (q *QuotaProcessor) checkpoint(start time.Time) {
+	q.mtx.Lock()
+	rollover := !q.period.IsZero() && start.After(q.period)
+	if q.period.IsZero() || rollover {
+		q.period = start
+	}
+	q.updates++
+	due := rollover || q.updates >= q.options.CheckpointEvery
+	if due {
+		q.updates = 0
+	}
+	q.mtx.Unlock()
+	if !due {
+		return
+	}
+
+	if rollover {
+		var past []events.Key
+		q.counters.Range(func(k events.Key, v interface{}) bool {
+			if v.(*quotaCounter).Start.Before(start) {
+				past = append(past, k)
+			}
+			return true
+		})
+		for _, k := range past {
+			// Unless counted again meanwhile
+			err := q.counters.Update(k, func(v interface{}, ok bool) interface{} {
+				if c, _ := v.(*quotaCounter); ok && c.Start.Before(start) {
+					return nil
+				}
+				return v
+			})
+			if err != nil {
+				log.Errorf("Error dropping quota counter of a past period: %v", err)
+			}
+		}
+	}
+	if err := q.counters.Checkpoint(); err != nil {
+		log.Errorf("Error checkpointing quota counters: %v", err)
+	}
+}
+
+// Used returns how many events of the key have been seen in the current period
+func (q *QuotaProcessor) Used(k events.Key) int64 {
+	v, ok := q.counters.Get(k)
+	if !ok {
+		return 0
+	}
+	c := v.(*quotaCounter)
+	if !c.Start.Equal(q.options.start(q.clock.Now())) {
+		return 0
+	}
+	return c.Count
+}
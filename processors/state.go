@@ -0,0 +1,559 @@
+// Keyed state for stateful processors.
+// A KeyedState holds one value per event Key behind its own lock, so processors
+// don't need to hand-roll maps and mutexes. Entries can expire after a period
+// without updates, their memory usage is estimated (and optionally capped), and
+// every change is written through to a StateBackend, so a processor created
+// again with the same backend starts from the state it had.
+
+package processors
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	events "github.com/getlantern/events-pipeline"
+)
+
+var (
+	ErrStateFull = errors.New("Keyed state memory limit reached")
+)
+
+// Rough memory used by a map entry and its bookkeeping, not counting key and value
+const stateEntryOverhead = 64
+
+// A value as stored in the backends
+type StateEntry struct {
+	Value   interface{}
+	Updated time.Time
+}
+
+type StateBackend interface {
+	// Load calls the function once for every stored entry
+	Load(func(events.Key, StateEntry)) error
+	Put(events.Key, StateEntry) error
+	Delete(events.Key) error
+	// Checkpoint replaces everything stored with the given snapshot
+	Checkpoint(map[events.Key]StateEntry) error
+	Close() error
+}
+
+type KeyedStateOptions struct {
+	// Entries not updated for this long are expired. Zero means never.
+	TTL time.Duration
+	// Limit on the estimated memory used by the entries. Zero means no limit.
+	MaxBytes uint64
+	// Estimates the memory used by an entry. Defaults to EstimateSize.
+	SizeFunc func(events.Key, interface{}) uint64
+	// Defaults to a MemoryStateBackend
+	Backend StateBackend
+	// Defaults to the system clock
+	Clock events.Clock
+}
+
+type stateEntry struct {
+	value   interface{}
+	updated time.Time
+	size    uint64
+}
+
+type KeyedState struct {
+	options *KeyedStateOptions
+
+	entries map[events.Key]*stateEntry
+	bytes   uint64
+	mtx     sync.Mutex
+}
+
+func NewKeyedState(opts *KeyedStateOptions) (*KeyedState, error) {
+	if opts.SizeFunc == nil {
+		opts.SizeFunc = EstimateSize
+	}
+	if opts.Backend == nil {
+		opts.Backend = NewMemoryStateBackend()
+	}
+	if opts.Clock == nil {
+		opts.Clock = events.SystemClock
+	}
+
+	s := &KeyedState{
+		options: opts,
+		entries: make(map[events.Key]*stateEntry),
+	}
+	err := opts.Backend.Load(func(k events.Key, e StateEntry) {
+		s.set(k, e.Value, e.Updated)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Some of the loaded entries may have expired while nobody was looking
+	s.Expire()
+	return s, nil
+}
+
+func (s *KeyedState) Get(k events.Key) (interface{}, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	e, ok := s.entries[k]
+	if !ok {
+		return nil, false
+	}
+	if s.expired(e, s.options.Clock.Now()) {
+		s.remove(k)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (s *KeyedState) Put(k events.Key, v interface{}) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.put(k, v)
+}
+
+// Update atomically replaces the value of a key with the one returned by the function,
+// which receives the current value, if any. Returning nil deletes the entry.
+func (s *KeyedState) Update(k events.Key, fn func(v interface{}, ok bool) interface{}) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var current interface{}
+	e, ok := s.entries[k]
+	if ok && s.expired(e, s.options.Clock.Now()) {
+		s.remove(k)
+		ok = false
+	} else if ok {
+		current = e.value
+	}
+
+	v := fn(current, ok)
+	if v == nil {
+		if ok {
+			return s.remove(k)
+		}
+		return nil
+	}
+	return s.put(k, v)
+}
+
+func (s *KeyedState) Delete(k events.Key) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.entries[k]; !ok {
+		return nil
+	}
+	return s.remove(k)
+}
+
+// Range calls the function for every live entry until it returns false.
+// The state is locked during the iteration, so the function must not use it.
+func (s *KeyedState) Range(fn func(events.Key, interface{}) bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := s.options.Clock.Now()
+	for k, e := range s.entries {
+		if s.expired(e, now) {
+			continue
+		}
+		if !fn(k, e.value) {
+			return
+		}
+	}
+}
+
+// Drain calls the function for every live entry and empties the state.
+// This is what processors flushing their accumulated values need.
+func (s *KeyedState) Drain(fn func(events.Key, interface{})) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := s.options.Clock.Now()
+	for k, e := range s.entries {
+		if !s.expired(e, now) {
+			fn(k, e.value)
+		}
+	}
+	s.entries = make(map[events.Key]*stateEntry)
+	s.bytes = 0
+
+	return s.options.Backend.Checkpoint(map[events.Key]StateEntry{})
+}
+
+// Expire removes the entries that have not been updated within the TTL, and
+// returns how many were removed
+func (s *KeyedState) Expire() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.expire(s.options.Clock.Now())
+}
+
+func (s *KeyedState) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return len(s.entries)
+}
+
+// Bytes returns the estimated memory used by the entries
+func (s *KeyedState) Bytes() uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.bytes
+}
+
+// Checkpoint writes a snapshot of the state to the backend, which can then drop
+// the history of changes that led to it
+func (s *KeyedState) Checkpoint() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.options.Backend.Checkpoint(s.snapshot())
+}
+
+func (s *KeyedState) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.options.Backend.Close()
+}
+
+func (s *KeyedState) expired(e *stateEntry, now time.Time) bool {
+	return s.options.TTL != 0 && now.Sub(e.updated) >= s.options.TTL
+}
+
+func (s *KeyedState) expire(now time.Time) int {
+	if s.options.TTL == 0 {
+		return 0
+	}
+	n := 0
+	for k, e := range s.entries {
+		if s.expired(e, now) {
+			if err := s.remove(k); err != nil {
+				log.Errorf("Error expiring state entry for key %v: %v", k, err)
+				continue
+			}
+			n++
+		}
+	}
+	return n
+}
+
+func (s *KeyedState) put(k events.Key, v interface{}) error {
+	now := s.options.Clock.Now()
+	size := s.options.SizeFunc(k, v)
+
+	if s.options.MaxBytes != 0 {
+		var oldSize uint64
+		if e, ok := s.entries[k]; ok {
+			oldSize = e.size
+		}
+		if s.bytes-oldSize+size > s.options.MaxBytes {
+			// Make room with the expired entries before giving up
+			s.expire(now)
+			if e, ok := s.entries[k]; ok {
+				oldSize = e.size
+			} else {
+				oldSize = 0
+			}
+			if s.bytes-oldSize+size > s.options.MaxBytes {
+				return ErrStateFull
+			}
+		}
+	}
+
+	if err := s.options.Backend.Put(k, StateEntry{Value: v, Updated: now}); err != nil {
+		return err
+	}
+	s.setSized(k, v, now, size)
+	return nil
+}
+
+func (s *KeyedState) set(k events.Key, v interface{}, updated time.Time) {
+	s.setSized(k, v, updated, s.options.SizeFunc(k, v))
+}
+
+func (s *KeyedState) setSized(k events.Key, v interface{}, updated time.Time, size uint64) {
+	if e, ok := s.entries[k]; ok {
+		s.bytes -= e.size
+	}
+	s.entries[k] = &stateEntry{value: v, updated: updated, size: size}
+	s.bytes += size
+}
+
+func (s *KeyedState) remove(k events.Key) error {
+	if err := s.options.Backend.Delete(k); err != nil {
+		return err
+	}
+	s.bytes -= s.entries[k].size
+	delete(s.entries, k)
+	return nil
+}
+
+func (s *KeyedState) snapshot() map[events.Key]StateEntry {
+	snapshot := make(map[events.Key]StateEntry, len(s.entries))
+	for k, e := range s.entries {
+		snapshot[k] = StateEntry{Value: e.value, Updated: e.updated}
+	}
+	return snapshot
+}
+
+// EstimateSize makes a rough estimation of the memory used by a state entry
+func EstimateSize(k events.Key, v interface{}) uint64 {
+	return stateEntryOverhead + uint64(len(k)) + estimateValueSize(v)
+}
+
+func estimateValueSize(v interface{}) uint64 {
+	switch t := v.(type) {
+	case nil:
+		return 0
+	case bool, int8, uint8:
+		return 1
+	case int16, uint16:
+		return 2
+	case int32, uint32, float32:
+		return 4
+	case int, int64, uint, uint64, float64, time.Duration:
+		return 8
+	case time.Time:
+		return 24
+	case string:
+		return 16 + uint64(len(t))
+	case []byte:
+		return 24 + uint64(len(t))
+	case []float64:
+		return 24 + 8*uint64(len(t))
+	case events.Vals:
+		size := uint64(48)
+		for vk, vv := range t {
+			size += 16 + uint64(len(vk)) + estimateValueSize(vv)
+		}
+		return size
+	case *events.Event:
+		return 64 + uint64(len(t.Key)) + estimateValueSize(t.Vals)
+	default:
+		// Fall back to the size of its encoding
+		var c countingWriter
+		if err := gob.NewEncoder(&c).Encode(v); err != nil {
+			return 64
+		}
+		return uint64(c)
+	}
+}
+
+type countingWriter uint64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+// Memory State Backend
+// Keeps the entries around for the lifetime of the process, so a processor can
+// be recreated (i.e. when a pipeline is rebuilt) without losing its state.
+type MemoryStateBackend struct {
+	entries map[events.Key]StateEntry
+	mtx     sync.Mutex
+}
+
+func NewMemoryStateBackend() *MemoryStateBackend {
+	return &MemoryStateBackend{
+		entries: make(map[events.Key]StateEntry),
+	}
+}
+
+func (b *MemoryStateBackend) Load(fn func(events.Key, StateEntry)) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for k, e := range b.entries {
+		fn(k, e)
+	}
+	return nil
+}
+
+func (b *MemoryStateBackend) Put(k events.Key, e StateEntry) error {
+	b.mtx.Lock()
+	b.entries[k] = e
+	b.mtx.Unlock()
+	return nil
+}
+
+func (b *MemoryStateBackend) Delete(k events.Key) error {
+	b.mtx.Lock()
+	delete(b.entries, k)
+	b.mtx.Unlock()
+	return nil
+}
+
+func (b *MemoryStateBackend) Checkpoint(snapshot map[events.Key]StateEntry) error {
+	entries := make(map[events.Key]StateEntry, len(snapshot))
+	for k, e := range snapshot {
+		entries[k] = e
+	}
+
+	b.mtx.Lock()
+	b.entries = entries
+	b.mtx.Unlock()
+	return nil
+}
+
+func (b *MemoryStateBackend) Close() error {
+	return nil
+}
+
+// File State Backend
+// Appends every change to a gob stream. The file is compacted into a snapshot
+// when opened and on every checkpoint, which also means that a torn record left
+// by a crash is only ever at the tail.
+// Values other than the basic types must be registered with gob.Register.
+
+type stateOp uint8
+
+const (
+	stateOpPut    stateOp = 1
+	stateOpDelete stateOp = 2
+)
+
+type stateRecord struct {
+	Op    stateOp
+	Key   events.Key
+	Entry StateEntry
+}
+
+type FileStateBackend struct {
+	path   string
+	file   *os.File
+	e      *gob.Encoder
+	loaded map[events.Key]StateEntry
+	mtx    sync.Mutex
+}
+
+func NewFileStateBackend(path string) (*FileStateBackend, error) {
+	b := &FileStateBackend{path: path}
+
+	loaded, err := b.read()
+	if err != nil {
+		return nil, err
+	}
+	// Start a fresh stream: gob cannot resume encoding on an existing one
+	if err := b.Checkpoint(loaded); err != nil {
+		return nil, err
+	}
+	b.loaded = loaded
+
+	return b, nil
+}
+
+func (b *FileStateBackend) read() (map[events.Key]StateEntry, error) {
+	entries := make(map[events.Key]StateEntry)
+
+	f, err := os.Open(b.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	d := gob.NewDecoder(f)
+	for {
+		var r stateRecord
+		err := d.Decode(&r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// Keep everything before the damaged record
+			log.Errorf("Error reading state file %v, ignoring the rest of it: %v", b.path, err)
+			break
+		}
+		switch r.Op {
+		case stateOpPut:
+			entries[r.Key] = r.Entry
+		case stateOpDelete:
+			delete(entries, r.Key)
+		}
+	}
+	return entries, nil
+}
+
+func (b *FileStateBackend) Load(fn func(events.Key, StateEntry)) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for k, e := range b.loaded {
+		fn(k, e)
+	}
+	b.loaded = nil
+	return nil
+}
+
+func (b *FileStateBackend) Put(k events.Key, e StateEntry) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.e.Encode(&stateRecord{Op: stateOpPut, Key: k, Entry: e})
+}
+
+func (b *FileStateBackend) Delete(k events.Key) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.e.Encode(&stateRecord{Op: stateOpDelete, Key: k})
+}
+
+func (b *FileStateBackend) Checkpoint(snapshot map[events.Key]StateEntry) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	tmpPath := b.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	e := gob.NewEncoder(f)
+	for k, entry := range snapshot {
+		if err := e.Encode(&stateRecord{Op: stateOpPut, Key: k, Entry: entry}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, b.path); err != nil {
+		f.Close()
+		return err
+	}
+
+	// Keep appending to the snapshot we just wrote
+	if b.file != nil {
+		b.file.Close()
+	}
+	b.file = f
+	b.e = e
+	return nil
+}
+
+func (b *FileStateBackend) Close() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
@@ -0,0 +1,426 @@
+// A token bucket rate limiter.
+// Every key has a bucket holding up to Burst tokens, refilled at Rate tokens per
+// second, and each event takes one token or is discarded. Unlike fixed windows,
+// this never lets through more than Burst events plus Rate per second over any
+// period of time.
+// The rule of each key is, in order of preference: the rule with exactly that
+// key as pattern, the first rule with a matching glob pattern, or the default rule.
+// Besides the key, events can be limited by the values of some of their fields
+// (i.e. per user or device) and globally, with a list of scopes evaluated in
+// order. An event goes through only if every scope lets it, and the tokens it
+// took from the scopes before the one discarding it are given back.
+
+package processors
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	events "github.com/getlantern/events-pipeline"
+)
+
+type RateLimitRule struct {
+	// Glob pattern of the keys the rule applies to, with the syntax of path.Match
+	// (i.e. "proxy.*"). Not used in the default rule.
+	Pattern string
+	// Events per second. Zero discards all the events.
+	Rate float64
+	// Events that can go through at once. Defaults to the rate, and at least 1.
+	Burst float64
+}
+
+func (r *RateLimitRule) setDefaults() {
+	if r.Rate < 0 {
+		panic("Rate limits cannot be negative")
+	}
+	if r.Rate == 0 {
+		r.Burst = 0
+	} else if r.Burst == 0 {
+		r.Burst = math.Max(r.Rate, 1)
+	}
+}
+
+// How long it takes an empty bucket of the rule to be full again
+func (r *RateLimitRule) refillTime() time.Duration {
+	if r.Rate == 0 {
+		return 0
+	}
+	return time.Duration(r.Burst / r.Rate * float64(time.Second))
+}
+
+type ScopeType int
+
+const (
+	// A bucket per event key, with the limits of the rules
+	KeyScope ScopeType = iota
+	// A bucket per combination of values of the scope fields
+	FieldsScope
+	// A single bucket for all the events
+	GlobalScope
+)
+
+type RateLimitScope struct {
+	Type ScopeType
+	// The fields of a FieldsScope. Events without any of them aren't limited by it.
+	Fields []string
+	// The limits of a FieldsScope or GlobalScope. KeyScope uses the rules instead.
+	Limit RateLimitRule
+	// Name of the scope in the metrics. Defaults to "key", "global", or "fields:"
+	// followed by the fields separated by commas.
+	Name string
+}
+
+func (s *RateLimitScope) setDefaults() {
+	switch s.Type {
+	case KeyScope:
+	case FieldsScope:
+		if len(s.Fields) == 0 {
+			panic("Fields rate limit scopes need at least one field")
+		}
+	case GlobalScope:
+	default:
+		panic("Unknown rate limit scope type")
+	}
+	if s.Type != KeyScope {
+		if s.Limit.Rate == 0 {
+			panic("Limiting the number of events to 0 per time unit makes no sense")
+		}
+		s.Limit.setDefaults()
+	}
+
+	if s.Name == "" {
+		switch s.Type {
+		case KeyScope:
+			s.Name = "key"
+		case FieldsScope:
+			s.Name = "fields:" + strings.Join(s.Fields, ",")
+		case GlobalScope:
+			s.Name = "global"
+		}
+	}
+}
+
+// dimension returns what identifies the bucket of the event within the scope,
+// or false if the scope doesn't apply to it
+func (s *RateLimitScope) dimension(evt *events.Event) (string, bool) {
+	switch s.Type {
+	case KeyScope:
+		return string(evt.Key), true
+	case FieldsScope:
+		vals := make([]string, len(s.Fields))
+		for i, f := range s.Fields {
+			v, ok := evt.Vals[f]
+			if !ok {
+				return "", false
+			}
+			// With the type, so that i.e. 1 and "1" are different users
+			vals[i] = fmt.Sprintf("%T:%v", v, v)
+		}
+		return strings.Join(vals, "\x00"), true
+	}
+	return "", true
+}
+
+type TokenBucketLimiterOptions struct {
+	Default RateLimitRule
+	Rules   []RateLimitRule
+	// Defaults to a single KeyScope
+	Scopes []RateLimitScope
+	// Defaults to the pipeline clock
+	Clock events.Clock
+}
+
+type RateLimiterMetrics struct {
+	Allowed   uint64
+	Throttled uint64
+	// By the pattern of the rule applied, empty for the default rule. Only the
+	// events discarded by the KeyScope count in ThrottledByRule.
+	AllowedByRule   map[string]uint64
+	ThrottledByRule map[string]uint64
+	// By the name of the scope that discarded the events
+	ThrottledByScope map[string]uint64
+}
+
+type tokenBucket struct {
+	Tokens float64
+	Last   time.Time
+}
+
+// take refills the bucket for the time elapsed and takes a token, if there's any
+func (b *tokenBucket) take(rule *RateLimitRule, now time.Time) bool {
+	if elapsed := now.Sub(b.Last); elapsed > 0 {
+		b.Tokens = math.Min(rule.Burst, b.Tokens+elapsed.Seconds()*rule.Rate)
+	}
+	b.Last = now
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return true
+	}
+	return false
+}
+
+type TokenBucketLimiter struct {
+	*events.ProcessorBase
+	options *TokenBucketLimiterOptions
+
+	exact map[events.Key]*RateLimitRule
+	globs []*RateLimitRule
+
+	buckets *KeyedState
+	clock   *switchableClock
+
+	lastExpire time.Time
+	metrics    RateLimiterMetrics
+	mtx        sync.Mutex
+}
+
+func NewTokenBucketLimiter(id string, opts *TokenBucketLimiterOptions) *TokenBucketLimiter {
+	if len(opts.Scopes) == 0 {
+		opts.Scopes = []RateLimitScope{{Type: KeyScope}}
+	}
+	byKey := false
+	for i := range opts.Scopes {
+		opts.Scopes[i].setDefaults()
+		byKey = byKey || opts.Scopes[i].Type == KeyScope
+	}
+
+	if byKey && opts.Default.Rate == 0 {
+		panic("Limiting the number of events to 0 per time unit makes no sense")
+	}
+	opts.Default.Pattern = ""
+	opts.Default.setDefaults()
+
+	clock := &switchableClock{opts.Clock}
+	if opts.Clock == nil {
+		clock.Clock = events.SystemClock
+	}
+
+	r := &TokenBucketLimiter{
+		ProcessorBase: events.NewProcessorBase(id, nil),
+		options:       opts,
+		exact:         make(map[events.Key]*RateLimitRule),
+		clock:         clock,
+		metrics: RateLimiterMetrics{
+			AllowedByRule:    make(map[string]uint64),
+			ThrottledByRule:  make(map[string]uint64),
+			ThrottledByScope: make(map[string]uint64),
+		},
+	}
+
+	// A bucket left alone long enough to refill is the same as no bucket at all
+	ttl := opts.Default.refillTime()
+	for i := range opts.Rules {
+		rule := &opts.Rules[i]
+		rule.setDefaults()
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			panic("Bad rate limit rule pattern: " + rule.Pattern)
+		}
+		if rt := rule.refillTime(); rt > ttl {
+			ttl = rt
+		}
+
+		if hasGlob(rule.Pattern) {
+			r.globs = append(r.globs, rule)
+		} else if _, ok := r.exact[events.Key(rule.Pattern)]; !ok {
+			r.exact[events.Key(rule.Pattern)] = rule
+		}
+	}
+
+	for _, scope := range opts.Scopes {
+		if rt := scope.Limit.refillTime(); rt > ttl {
+			ttl = rt
+		}
+	}
+
+	var err error
+	r.buckets, err = NewKeyedState(&KeyedStateOptions{TTL: ttl, Clock: clock})
+	if err != nil {
+		panic(err)
+	}
+
+	return r
+}
+
+func hasGlob(pattern string) bool {
+	for _, c := range pattern {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
+
+func (r *TokenBucketLimiter) SetClock(c events.Clock) {
+	if r.options.Clock == nil {
+		r.clock.Clock = c
+	}
+}
+
+func (r *TokenBucketLimiter) Receive(evt *events.Event) error {
+	log.Tracef("TOKEN BUCKET LIMITER ID %v PROCESSED event: %v with: %v", r.ID(), evt.Key, evt.Vals)
+
+	// Handle the SystemEvent signals
+	if evt.Key == "" {
+		return nil
+	}
+
+	err := r.ProcessorBase.Receive(evt)
+	if err != nil {
+		return err
+	}
+
+	r.expireIdle()
+
+	var (
+		keyRule  *RateLimitRule
+		taken    []events.Key
+		rules    []*RateLimitRule
+		denied   *RateLimitScope
+		deniedBy *RateLimitRule
+	)
+	for i := range r.options.Scopes {
+		scope := &r.options.Scopes[i]
+		dim, ok := scope.dimension(evt)
+		if !ok {
+			continue
+		}
+
+		rule := &scope.Limit
+		if scope.Type == KeyScope {
+			rule = r.ruleFor(evt.Key)
+			keyRule = rule
+		}
+
+		// Buckets of different scopes can't collide, as the scope index goes first
+		k := events.Key(fmt.Sprintf("%d\x00%s", i, dim))
+		allowed, err := r.take(k, rule)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			denied = scope
+			if scope.Type == KeyScope {
+				deniedBy = rule
+			}
+			break
+		}
+		taken = append(taken, k)
+		rules = append(rules, rule)
+	}
+
+	if denied != nil {
+		for i, k := range taken {
+			r.giveBack(k, rules[i])
+		}
+	}
+	r.record(keyRule, denied, deniedBy)
+
+	if denied != nil {
+		return nil
+	}
+	return r.ProcessorBase.Send(evt)
+}
+
+func (r *TokenBucketLimiter) ruleFor(k events.Key) *RateLimitRule {
+	if rule, ok := r.exact[k]; ok {
+		return rule
+	}
+	for _, rule := range r.globs {
+		if ok, _ := path.Match(rule.Pattern, string(k)); ok {
+			return rule
+		}
+	}
+	return &r.options.Default
+}
+
+// expireIdle forgets the idle buckets every now and then
+func (r *TokenBucketLimiter) expireIdle() {
+	now := r.clock.Now()
+
+	r.mtx.Lock()
+	expire := r.buckets.options.TTL != 0 && now.Sub(r.lastExpire) >= r.buckets.options.TTL
+	if expire {
+		r.lastExpire = now
+	}
+	r.mtx.Unlock()
+	if expire {
+		r.buckets.Expire()
+	}
+}
+
+func (r *TokenBucketLimiter) take(k events.Key, rule *RateLimitRule) (bool, error) {
+	now := r.clock.Now()
+
+	var allowed bool
+	err := r.buckets.Update(k, func(v interface{}, ok bool) interface{} {
+		b, _ := v.(*tokenBucket)
+		if !ok {
+			b = &tokenBucket{Tokens: rule.Burst, Last: now}
+		}
+		allowed = b.take(rule, now)
+		return b
+	})
+	return allowed, err
+}
+
+// giveBack returns the token taken from a bucket for an event finally discarded
+func (r *TokenBucketLimiter) giveBack(k events.Key, rule *RateLimitRule) {
+	r.buckets.Update(k, func(v interface{}, ok bool) interface{} {
+		if !ok {
+			return nil
+		}
+		b := v.(*tokenBucket)
+		b.Tokens = math.Min(rule.Burst, b.Tokens+1)
+		return b
+	})
+}
+
+// record counts an event let through with the key rule applied, if any, or
+// discarded by the scope denied, with the rule that denied it if it's the
+// KeyScope
+func (r *TokenBucketLimiter) record(keyRule *RateLimitRule, denied *RateLimitScope, deniedBy *RateLimitRule) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if denied == nil {
+		r.metrics.Allowed++
+		if keyRule != nil {
+			r.metrics.AllowedByRule[keyRule.Pattern]++
+		}
+	} else {
+		r.metrics.Throttled++
+		if deniedBy != nil {
+			r.metrics.ThrottledByRule[deniedBy.Pattern]++
+		}
+		r.metrics.ThrottledByScope[denied.Name]++
+	}
+}
+
+// Metrics returns a snapshot of the decisions taken so far
+func (r *TokenBucketLimiter) Metrics() RateLimiterMetrics {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	m := RateLimiterMetrics{
+		Allowed:          r.metrics.Allowed,
+		Throttled:        r.metrics.Throttled,
+		AllowedByRule:    make(map[string]uint64, len(r.metrics.AllowedByRule)),
+		ThrottledByRule:  make(map[string]uint64, len(r.metrics.ThrottledByRule)),
+		ThrottledByScope: make(map[string]uint64, len(r.metrics.ThrottledByScope)),
+	}
+	for p, n := range r.metrics.AllowedByRule {
+		m.AllowedByRule[p] = n
+	}
+	for p, n := range r.metrics.ThrottledByRule {
+		m.ThrottledByRule[p] = n
+	}
+	for s, n := range r.metrics.ThrottledByScope {
+		m.ThrottledByScope[s] = n
+	}
+	return m
+}
@@ -0,0 +1,376 @@
+// A windowed aggregator applies the aggregation directives to the events that
+// fall in a time window, and emits one event with the result when the window
+// closes. The events aggregated are consumed, while events without a matching
+// directive go through untouched.
+// Time can be either the events' timestamps (event time) or the time at which
+// they are processed (processing time). With event time, a window is closed
+// once an event more recent than its end (plus the allowed lateness) is seen,
+// and events arriving for windows already closed are discarded.
+
+package processors
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	events "github.com/getlantern/events-pipeline"
+)
+
+type WindowType int
+
+const (
+	// Fixed size, non-overlapping windows
+	TumblingWindow WindowType = iota
+	// Fixed size windows starting every Hop, so they overlap when Hop < Size
+	SlidingWindow
+	// Windows that extend while events keep coming within Gap of each other
+	SessionWindow
+)
+
+type TimeDomain int
+
+const (
+	ProcessingTime TimeDomain = iota
+	EventTime
+)
+
+// Vals added to the emitted events
+const (
+	WindowStartVal = "window_start"
+	WindowEndVal   = "window_end"
+)
+
+type WindowOptions struct {
+	Type WindowType
+	Time TimeDomain
+	Size time.Duration
+	Hop  time.Duration
+	Gap  time.Duration
+
+	// How long event time windows are kept open after their end
+	AllowedLateness time.Duration
+	// Defaults to the pipeline clock
+	Clock events.Clock
+	// Options of the directives, in the same order. The ones past the end of the
+	// list have none.
+	Directives []AggregationDirectiveOptions
+}
+
+type windowKey struct {
+	group string
+	start time.Time
+}
+
+type window struct {
+	start  time.Time
+	end    time.Time
+	accum  interface{}
+	value  interface{}
+	fields events.Vals
+}
+
+type openWindows struct {
+	windows map[windowKey]*window
+	// Number of open windows of each group
+	groups map[string]int
+}
+
+func (ow *openWindows) exists(group string) bool {
+	_, ok := ow.groups[group]
+	return ok
+}
+
+func (ow *openWindows) add(k windowKey, w *window) {
+	ow.windows[k] = w
+	ow.groups[k.group]++
+}
+
+func (ow *openWindows) remove(k windowKey) {
+	delete(ow.windows, k)
+	if ow.groups[k.group]--; ow.groups[k.group] == 0 {
+		delete(ow.groups, k.group)
+	}
+}
+
+type WindowedAggregator struct {
+	*events.ProcessorBase
+	options    *WindowOptions
+	directives []directive
+
+	// Open windows for each directive
+	windows   []*openWindows
+	watermark time.Time
+	mtx       sync.Mutex
+
+	clock events.Clock
+	stop  chan struct{}
+}
+
+func NewWindowedAggregator(id string, opts *WindowOptions, ds ...AggregationDirective) *WindowedAggregator {
+	switch opts.Type {
+	case TumblingWindow:
+		if opts.Size <= 0 {
+			panic("Tumbling windows need a Size")
+		}
+	case SlidingWindow:
+		if opts.Size <= 0 || opts.Hop <= 0 {
+			panic("Sliding windows need a Size and a Hop")
+		}
+	case SessionWindow:
+		if opts.Gap <= 0 {
+			panic("Session windows need a Gap")
+		}
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = events.SystemClock
+	}
+
+	windows := make([]*openWindows, len(ds))
+	for i := range ds {
+		windows[i] = &openWindows{
+			windows: make(map[windowKey]*window),
+			groups:  make(map[string]int),
+		}
+	}
+
+	return &WindowedAggregator{
+		ProcessorBase: events.NewProcessorBase(id, nil),
+		options:       opts,
+		directives:    withOptions(ds, opts.Directives),
+		windows:       windows,
+		clock:         clock,
+	}
+}
+
+func (a *WindowedAggregator) SetClock(c events.Clock) {
+	if a.options.Clock == nil {
+		a.clock = c
+	}
+}
+
+func (a *WindowedAggregator) Receive(evt *events.Event) error {
+	log.Tracef("WINDOWED AGGREGATOR ID %v PROCESSED event: %v with: %v", a.ID(), evt.Key, evt.Vals)
+
+	// Handle the SystemEvent signals
+	if evt.Key == "" {
+		if _, ok := evt.Vals[string(events.SystemEventInit)]; ok {
+			a.start()
+		} else if _, ok := evt.Vals[string(events.SystemEventStop)]; ok {
+			if a.stop != nil {
+				close(a.stop)
+				a.stop = nil
+			}
+			return a.closeAll()
+		}
+		return nil
+	}
+
+	err := a.ProcessorBase.Receive(evt)
+	if err != nil {
+		return err
+	}
+
+	now := a.clock.Now()
+	ts := now
+	if a.options.Time == EventTime {
+		ts = evt.Timestamp
+	}
+
+	a.mtx.Lock()
+	matched := false
+	for i, d := range a.directives {
+		if evt.Key != d.Key {
+			continue
+		}
+		matched = true
+		if val, ok := evt.Vals[d.Val]; ok {
+			a.assign(i, ts, evt.Vals, val)
+		}
+	}
+	a.mtx.Unlock()
+
+	if !matched {
+		return a.ProcessorBase.Send(evt)
+	}
+	return a.advance(ts)
+}
+
+// Advance closes and emits the windows that ended by the current time.
+// It is called periodically when using processing time.
+func (a *WindowedAggregator) Advance() error {
+	return a.advance(a.clock.Now())
+}
+
+func (a *WindowedAggregator) start() {
+	if a.options.Time != ProcessingTime || a.stop != nil {
+		return
+	}
+
+	period := a.options.Size
+	if a.options.Type == SlidingWindow {
+		period = a.options.Hop
+	} else if a.options.Type == SessionWindow {
+		period = a.options.Gap
+	}
+
+	a.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := a.clock.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.Chan():
+				if err := a.Advance(); err != nil {
+					log.Errorf("Error emitting windows: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(a.stop)
+}
+
+// Must be called with the lock held
+func (a *WindowedAggregator) assign(i int, ts time.Time, vals events.Vals, val interface{}) {
+	d := a.directives[i]
+	ow := a.windows[i]
+	group, fields := d.groupOf(vals, ow.exists, len(ow.groups))
+
+	switch a.options.Type {
+	case TumblingWindow:
+		start := ts.Truncate(a.options.Size)
+		a.apply(d, ow, group, fields, start, start.Add(a.options.Size), val)
+	case SlidingWindow:
+		// Every window starting in (ts - Size, ts] contains the event
+		last := ts.Truncate(a.options.Hop)
+		for start := last; start.Add(a.options.Size).After(ts); start = start.Add(-a.options.Hop) {
+			a.apply(d, ow, group, fields, start, start.Add(a.options.Size), val)
+		}
+	case SessionWindow:
+		// There is at most one open session per group
+		var session *window
+		for k, w := range ow.windows {
+			if k.group == group {
+				session = w
+			}
+		}
+		if session != nil && !ts.Before(session.start.Add(-a.options.Gap)) && ts.Before(session.end) {
+			if ts.Before(session.start) {
+				ow.remove(windowKey{group, session.start})
+				session.start = ts
+				ow.add(windowKey{group, ts}, session)
+			}
+			if end := ts.Add(a.options.Gap); end.After(session.end) {
+				session.end = end
+			}
+			session.accum, session.value = d.AggregatorFunc(session.accum, val)
+			return
+		}
+		if session != nil && ts.Before(session.start) {
+			// Too late for the current session
+			return
+		}
+		// The previous session, if any, gets closed on the next advance
+		a.apply(d, ow, group, fields, ts, ts.Add(a.options.Gap), val)
+	}
+}
+
+func (a *WindowedAggregator) apply(d directive, ow *openWindows, group string, fields events.Vals, start, end time.Time, val interface{}) {
+	if !end.After(a.watermark) {
+		// The window was already closed
+		return
+	}
+	k := windowKey{group, start}
+	w, ok := ow.windows[k]
+	if !ok {
+		w = &window{start: start, end: end, accum: d.Identity, fields: fields}
+		ow.add(k, w)
+	}
+	w.accum, w.value = d.AggregatorFunc(w.accum, val)
+}
+
+func (a *WindowedAggregator) advance(ts time.Time) error {
+	a.mtx.Lock()
+	watermark := ts
+	if a.options.Time == EventTime {
+		watermark = ts.Add(-a.options.AllowedLateness)
+	}
+	if watermark.After(a.watermark) {
+		a.watermark = watermark
+	}
+	closed := a.collect(func(w *window) bool {
+		return !w.end.After(a.watermark)
+	})
+
+	// Sessions end when a new one of the same group starts, even if still within their gap
+	if a.options.Type == SessionWindow {
+		for i, ow := range a.windows {
+			latest := make(map[string]*window)
+			for k, w := range ow.windows {
+				if l, ok := latest[k.group]; !ok || w.start.After(l.start) {
+					latest[k.group] = w
+				}
+			}
+			for k, w := range ow.windows {
+				if w != latest[k.group] {
+					closed = append(closed, a.result(i, w))
+					ow.remove(k)
+				}
+			}
+		}
+	}
+	a.mtx.Unlock()
+
+	return a.emit(closed)
+}
+
+func (a *WindowedAggregator) closeAll() error {
+	a.mtx.Lock()
+	closed := a.collect(func(w *window) bool { return true })
+	a.mtx.Unlock()
+
+	return a.emit(closed)
+}
+
+// Must be called with the lock held
+func (a *WindowedAggregator) collect(isClosed func(*window) bool) []*events.Event {
+	var closed []*events.Event
+	for i, ow := range a.windows {
+		for k, w := range ow.windows {
+			if isClosed(w) {
+				closed = append(closed, a.result(i, w))
+				ow.remove(k)
+			}
+		}
+	}
+	return closed
+}
+
+func (a *WindowedAggregator) result(i int, w *window) *events.Event {
+	d := a.directives[i]
+	vals := events.Vals{
+		d.output():     w.value,
+		WindowStartVal: w.start,
+		WindowEndVal:   w.end,
+	}
+	for f, v := range w.fields {
+		vals[f] = v
+	}
+	evt := events.NewEvent(d.Key, &vals)
+	evt.Timestamp = w.end
+	return evt
+}
+
+func (a *WindowedAggregator) emit(closed []*events.Event) error {
+	sort.SliceStable(closed, func(i, j int) bool {
+		return closed[i].Timestamp.Before(closed[j].Timestamp)
+	})
+	for _, evt := range closed {
+		if err := a.ProcessorBase.Send(evt); err != nil {
+			return err
+		}
+	}
+	return nil
+}